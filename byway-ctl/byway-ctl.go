@@ -2,8 +2,8 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"net/http"
+	"os"
 	"strconv"
 
 	"encoding/json"
@@ -12,6 +12,8 @@ import (
 	"github.com/amerdrix/byway/core"
 )
 
+var logger = core.Logger().With("component", "ctl")
+
 func cors(inner func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -20,13 +22,32 @@ func cors(inner func(w http.ResponseWriter, r *http.Request)) func(w http.Respon
 	}
 }
 
+// validate rejects, with a bad request, changes which the proxy would refuse to load
+func validate(w http.ResponseWriter, change func(config *core.Config)) bool {
+	config := core.NewConfig()
+	change(config)
+
+	err := core.ValidateConfig(config)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return false
+	}
+	return true
+}
+
 func createRewrite(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodOptions {
 
 	} else if r.Method == http.MethodPost {
 		r.ParseForm()
 		rewrite := string(r.Form["rewrite"][0])
-		log.Println(rewrite)
+		logger.Debug("create rewrite", "rewrite", rewrite)
+		if !validate(w, func(config *core.Config) {
+			config.Rewrites = append(config.Rewrites, core.RewriteConfigString(rewrite))
+		}) {
+			return
+		}
 		err := bywayConfig.CreateRewrite(core.RewriteConfigString(rewrite))
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -38,13 +59,109 @@ func createRewrite(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func readRule(r *http.Request, rule interface{}) error {
+	return json.Unmarshal([]byte(r.FormValue("rule")), rule)
+}
+
+func createRewriteRule(w http.ResponseWriter, r *http.Request) {
+	rule := core.RewriteRuleConfig{}
+	createRule(w, r, &rule, func(config *core.Config) {
+		config.RewriteRules = append(config.RewriteRules, rule)
+	}, func() error {
+		return bywayConfig.CreateRewriteRule(&rule)
+	})
+}
+
+func deleteRewriteRule(w http.ResponseWriter, r *http.Request) {
+	rule := core.RewriteRuleConfig{}
+	deleteRule(w, r, &rule, func(index int64) error { return bywayConfig.RemoveRewriteRule(index, &rule) })
+}
+
+func createRedirect(w http.ResponseWriter, r *http.Request) {
+	rule := core.RedirectRuleConfig{}
+	createRule(w, r, &rule, func(config *core.Config) {
+		config.Redirects = append(config.Redirects, rule)
+	}, func() error {
+		return bywayConfig.CreateRedirect(&rule)
+	})
+}
+
+func deleteRedirect(w http.ResponseWriter, r *http.Request) {
+	rule := core.RedirectRuleConfig{}
+	deleteRule(w, r, &rule, func(index int64) error { return bywayConfig.RemoveRedirect(index, &rule) })
+}
+
+// createRule reads a json encoded rule from the form into rule, validates it
+// once added to a config by change and stores it with create
+func createRule(w http.ResponseWriter, r *http.Request, rule interface{}, change func(config *core.Config), create func() error) {
+	if r.Method == http.MethodOptions {
+
+	} else if r.Method == http.MethodPost {
+		r.ParseForm()
+		err := readRule(r, rule)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, err)
+			return
+		}
+		logger.Debug("create rule", "path", r.URL.Path, "rule", r.FormValue("rule"))
+		if !validate(w, change) {
+			return
+		}
+		err = create()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, err)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	} else {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// deleteRule reads a json encoded rule and its index from the form and removes it with remove
+func deleteRule(w http.ResponseWriter, r *http.Request, rule interface{}, remove func(int64) error) {
+	if r.Method == http.MethodOptions {
+
+	} else if r.Method == http.MethodPost {
+		err := r.ParseForm()
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, err)
+			return
+		}
+		index, err := strconv.Atoi(r.FormValue("index"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, err)
+			return
+		}
+		err = readRule(r, rule)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, err)
+			return
+		}
+		err = remove(int64(index))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, err)
+			return
+		}
+		fmt.Fprint(w, "delete ok")
+	} else {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
 func createService(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodOptions {
 
 	} else if r.Method == http.MethodPost {
 		r.ParseForm()
 		name := string(r.Form["name"][0])
-		log.Println(name)
+		logger.Debug("create service", "service", name)
 		err := bywayConfig.CreateService(core.ServiceName(name))
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -65,12 +182,20 @@ func createBinding(w http.ResponseWriter, r *http.Request) {
 		version := string(r.Form["version"][0])
 
 		endpoint := core.EndpointConfig{
-			Host:    r.Form["host"][0],
-			Scheme:  r.Form["scheme"][0],
-			Headers: make(map[string]string),
+			Host:             r.Form["host"][0],
+			Scheme:           r.Form["scheme"][0],
+			Rewrite:          r.FormValue("rewrite"),
+			Headers:          make(map[string]string),
+			ProxyProtocol:    r.FormValue("proxy_protocol"),
+			ForwardedHeaders: r.FormValue("forwarded_headers"),
 		}
 
-		log.Println(name)
+		logger.Debug("create binding", "service", name, "version", version)
+		if !validate(w, func(config *core.Config) {
+			config.Mapping[core.ServiceName(name)] = map[core.VersionString]core.EndpointConfig{core.VersionString(version): endpoint}
+		}) {
+			return
+		}
 		err := bywayConfig.CreateBinding(core.ServiceName(name), core.VersionString(version), &endpoint)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -83,7 +208,6 @@ func createBinding(w http.ResponseWriter, r *http.Request) {
 }
 
 func addServiceToTopology(w http.ResponseWriter, r *http.Request) {
-	log.Println("addServiceToTopology ------------")
 	if r.Method == http.MethodOptions {
 
 	} else if r.Method == http.MethodPost {
@@ -92,7 +216,7 @@ func addServiceToTopology(w http.ResponseWriter, r *http.Request) {
 		version := string(r.Form["service_version"][0])
 		key := string(r.Form["topology_key"][0])
 
-		log.Println(name)
+		logger.Debug("add service to topology", "topology", key, "service", name, "version", version)
 		err := bywayConfig.AddServiceToTopology(core.TopologyKey(key), core.ServiceName(name), core.VersionString(version))
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -110,7 +234,7 @@ func deleteRewrite(w http.ResponseWriter, r *http.Request) {
 	} else if r.Method == http.MethodPost {
 
 		err := r.ParseForm()
-		log.Println(r.Form)
+		logger.Debug("delete rewrite", "form", r.Form)
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			fmt.Fprint(w, err)
@@ -135,16 +259,112 @@ func deleteRewrite(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// logLevel reports the log level, or sets it here and, through redis, on every proxy
+func logLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+
+	} else if r.Method == http.MethodGet {
+		fmt.Fprint(w, core.LogLevel())
+	} else if r.Method == http.MethodPost {
+		r.ParseForm()
+		logging := &core.LoggingConfig{
+			Level:       r.FormValue("level"),
+			Format:      r.FormValue("format"),
+			DebugHeader: r.FormValue("debug_header"),
+			DebugToken:  r.FormValue("debug_token"),
+		}
+		if !validate(w, func(config *core.Config) {
+			config.Logging = logging
+		}) {
+			return
+		}
+		core.ApplyLoggingConfig(logging)
+		logger.Info("log level changed", "level", core.LogLevel())
+
+		err := bywayConfig.SetLogging(logging)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, err)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	} else {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// secret encrypts a secret with the key in core.SecretKeyEnv and stores it
+// for header values to refer to as {secret:name}. The value is never echoed
+func secret(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+
+	} else if r.Method == http.MethodPost {
+		r.ParseForm()
+		name := r.FormValue("name")
+		if name == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "name is required")
+			return
+		}
+
+		ciphertext, err := core.EncryptSecret(r.FormValue("value"))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, err)
+			return
+		}
+
+		logger.Info("set secret", "name", name)
+		err = bywayConfig.SetSecret(name, ciphertext)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, err)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	} else {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// purgeCache removes the cached responses of a service, or of one version of it
+func purgeCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+
+	} else if r.Method == http.MethodPost {
+		r.ParseForm()
+		serviceName := r.FormValue("service_name")
+		if serviceName == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "service_name is required")
+			return
+		}
+		version := r.FormValue("version")
+
+		logger.Info("purge cache", "service", serviceName, "version", version)
+		err := bywayConfig.PurgeCache(core.ServiceName(serviceName), core.VersionString(version))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, err)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	} else {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
 func serve(configChan chan *core.Config) func(http.ResponseWriter, *http.Request) {
 	config := core.NewConfig()
 	go func() {
 		for {
 			config = <-configChan
+			core.ApplyLoggingConfig(config.Logging)
 		}
 	}()
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		config := config
+		config := core.RedactSecrets(config)
 
 		js, err := json.Marshal(config)
 		if err != nil {
@@ -157,7 +377,7 @@ func serve(configChan chan *core.Config) func(http.ResponseWriter, *http.Request
 
 func main() {
 	port := ":1091"
-	fmt.Printf("Running manage on port %s\n", port)
+	logger.Info("running manage", "port", port)
 
 	config := make(chan *core.Config)
 	exit := make(chan bool)
@@ -166,16 +386,24 @@ func main() {
 	http.HandleFunc("/", cors(serve(config)))
 	http.HandleFunc("/rewrite", cors(createRewrite))
 	http.HandleFunc("/deleteRewrite", cors(deleteRewrite))
+	http.HandleFunc("/rewriteRule", cors(createRewriteRule))
+	http.HandleFunc("/deleteRewriteRule", cors(deleteRewriteRule))
+	http.HandleFunc("/redirect", cors(createRedirect))
+	http.HandleFunc("/secret", cors(secret))
+	http.HandleFunc("/purgeCache", cors(purgeCache))
+	http.HandleFunc("/deleteRedirect", cors(deleteRedirect))
 
 	http.HandleFunc("/createService", cors(createService))
 	http.HandleFunc("/createBinding", cors(createBinding))
 	http.HandleFunc("/addServiceToTopology", cors(addServiceToTopology))
+	http.HandleFunc("/logLevel", cors(logLevel))
 
 	err := http.ListenAndServe(port, nil)
 	if err != nil {
-		log.Fatal(err)
+		logger.Error("manage stopped", "err", err)
+		os.Exit(1)
 	}
 	exit <- true
-	fmt.Printf("Goodbye")
+	logger.Info("goodbye")
 
 }
@@ -31,12 +31,72 @@ interface BindingConfig {
     host: string
     rewrite: string
     headers: Map<string>
+    proxy_protocol?: string
+    forwarded_headers?: string
+    request_headers?: HeaderPolicy
+    response_headers?: HeaderPolicy
+    response_rewrite?: ResponseRewrite
+    body?: {
+        max_request_size?: number
+        max_response_size?: number
+        buffer_request?: boolean
+        buffer_response?: boolean
+        flush_interval?: string
+    }
+    compression?: CompressionConfig
+    cache?: boolean
+}
+
+interface CompressionConfig {
+    enabled?: boolean
+    encodings?: string[]
+    content_types?: string[]
+    min_size?: number
+    decompress?: boolean
+}
+
+interface ResponseRewrite {
+    location?: boolean
+    cookies?: boolean
+    public_host?: string
+    path_prefixes?: Map<string>
+    body?: {
+        content_types?: string[]
+        max_size?: number
+        replace?: Map<string>
+    }
+}
+
+interface HeaderPolicy {
+    set?: Map<string>
+    append?: Map<string>
+    remove?: string[]
+}
+
+interface RewriteRule {
+    match: string
+    replace: string
+    methods?: string[]
+    host?: string
+    headers?: Map<string>
+    topologies?: string[]
+    set_headers?: Map<string>
+    remove_headers?: string[]
+}
+
+interface RedirectRule {
+    match: string
+    target: string
+    status?: number
+    preserve_query?: boolean
 }
 
 type ServiceMap = Map<Map<BindingConfig>>
 
 interface BywayConfig {
     rewrites: RewriteList
+    rewrite_rules?: RewriteRule[]
+    redirects?: RedirectRule[]
     services: ServiceMap
 }
 
@@ -72,6 +132,33 @@ function createRewrite(rewrite: string) {
     }
 }
 
+function postRule(path: string, rule: RewriteRule | RedirectRule, index?: number) {
+    const body = index === undefined ? '' : `index=${index}&`
+    return fetch(`http://localhost:1091/${path}`, {
+        method: "POST",
+        headers: {
+            'Content-Type': 'application/x-www-form-urlencoded',
+        },
+        body: `${body}rule=${encodeURIComponent(JSON.stringify(rule))}`
+    })
+        .then(refresh)
+}
+
+function createRewriteRule(rule: RewriteRule) {
+    return () => postRule("rewriteRule", rule)
+}
+
+function deleteRewriteRule(index: number, rule: RewriteRule) {
+    return () => postRule("deleteRewriteRule", rule, index)
+}
+
+function createRedirect(rule: RedirectRule) {
+    return () => postRule("redirect", rule)
+}
+
+function deleteRedirect(index: number, rule: RedirectRule) {
+    return () => postRule("deleteRedirect", rule, index)
+}
 
 function createService(name: string) {
 
@@ -143,6 +230,136 @@ function Rewrites({ rewrites }: { rewrites: RewriteList }) {
     </div>
 }
 
+function splitList(value: string) {
+    return value.split(',').map(item => item.trim()).filter(item => item != '')
+}
+
+function Conditions({ rule }: { rule: RewriteRule }) {
+    const conditions: string[] = []
+    if (rule.methods && rule.methods.length)
+        conditions.push(rule.methods.join(', '))
+    if (rule.host)
+        conditions.push(`host ${rule.host}`)
+    Object.keys(rule.headers || {}).forEach(header => conditions.push(`${header}: ${rule.headers[header]}`))
+    if (rule.topologies && rule.topologies.length)
+        conditions.push(`topologies ${rule.topologies.join(', ')}`)
+    Object.keys(rule.set_headers || {}).forEach(header => conditions.push(`set ${header}: ${rule.set_headers[header]}`))
+    if (rule.remove_headers && rule.remove_headers.length)
+        conditions.push(`remove ${rule.remove_headers.join(', ')}`)
+    return <span className="col s12"> {conditions.join('; ')} </span>
+}
+
+class NewRewriteRule extends React.Component<{}, { match?: string, replace?: string, methods?: string, host?: string }> {
+    constructor() {
+        super()
+        this.state = { match: '', replace: '', methods: '', host: '' }
+    }
+    render() {
+        return <div className="row">
+            <h4> New Rule </h4>
+            <input className="col s5" type="text" placeholder="match" value={this.state.match} onChange={e => this.setState({ match: (e.target as HTMLInputElement).value })} />
+            <span className="col s1  center-align"> → </span>
+            <input className="col s5" type="text" placeholder="replace" value={this.state.replace} onChange={e => this.setState({ replace: (e.target as HTMLInputElement).value })} />
+            <input className="col s5" type="text" placeholder="methods, eg GET, HEAD" value={this.state.methods} onChange={e => this.setState({ methods: (e.target as HTMLInputElement).value })} />
+            <span className="col s1" />
+            <input className="col s5" type="text" placeholder="host" value={this.state.host} onChange={e => this.setState({ host: (e.target as HTMLInputElement).value })} />
+
+            <div className="col s1">
+                <a className="waves-effect waves-light btn" disabled={!this.state.match || !this.state.replace} onClick={() => {
+                    if (!this.state.match || !this.state.replace)
+                        return
+                    const rule: RewriteRule = { match: this.state.match, replace: this.state.replace }
+                    const methods = splitList(this.state.methods)
+                    if (methods.length)
+                        rule.methods = methods
+                    if (this.state.host)
+                        rule.host = this.state.host
+
+                    createRewriteRule(rule)()
+                    this.setState({ match: '', replace: '', methods: '', host: '' })
+                }
+                }> Create</a>
+            </div>
+        </div>
+    }
+}
+
+function RewriteRules({ rules }: { rules: RewriteRule[] }) {
+
+    return <div className="card-panel">
+        <h2>Rewrite Rules</h2>
+        <ul >
+            {rules.map((rule, index) => {
+                return <li className="row" key={index} onClick={deleteRewriteRule(index, rule)} >
+                    <span className="col s5"> <Code>{rule.match}</Code></span>
+                    <span className="col s2 center-align ">→</span>
+                    <span className="col s5"> <Code>{rule.replace}</Code></span>
+                    <Conditions rule={rule} />
+                </li>
+            }
+            )}
+        </ul>
+        <hr />
+        < NewRewriteRule />
+    </div>
+}
+
+class NewRedirect extends React.Component<{}, { match?: string, target?: string, status?: string, preserveQuery?: boolean }> {
+    constructor() {
+        super()
+        this.state = { match: '', target: '', status: '', preserveQuery: false }
+    }
+    render() {
+        return <div className="row">
+            <h4> New Redirect </h4>
+            <input className="col s5" type="text" placeholder="match" value={this.state.match} onChange={e => this.setState({ match: (e.target as HTMLInputElement).value })} />
+            <span className="col s1  center-align"> → </span>
+            <input className="col s5" type="text" placeholder="target" value={this.state.target} onChange={e => this.setState({ target: (e.target as HTMLInputElement).value })} />
+            <input className="col s2" type="number" placeholder="302" value={this.state.status} onChange={e => this.setState({ status: (e.target as HTMLInputElement).value })} />
+            <span className="col s4">
+                <input type="checkbox" id="preserve-query" checked={this.state.preserveQuery} onChange={e => this.setState({ preserveQuery: (e.target as HTMLInputElement).checked })} />
+                <label htmlFor="preserve-query">Preserve query</label>
+            </span>
+
+            <div className="col s1">
+                <a className="waves-effect waves-light btn" disabled={!this.state.match || !this.state.target} onClick={() => {
+                    if (!this.state.match || !this.state.target)
+                        return
+                    const rule: RedirectRule = { match: this.state.match, target: this.state.target }
+                    if (this.state.status)
+                        rule.status = parseInt(this.state.status, 10)
+                    if (this.state.preserveQuery)
+                        rule.preserve_query = true
+
+                    createRedirect(rule)()
+                    this.setState({ match: '', target: '', status: '', preserveQuery: false })
+                }
+                }> Create</a>
+            </div>
+        </div>
+    }
+}
+
+function Redirects({ redirects }: { redirects: RedirectRule[] }) {
+
+    return <div className="card-panel">
+        <h2>Redirects</h2>
+        <ul >
+            {redirects.map((rule, index) => {
+                return <li className="row" key={index} onClick={deleteRedirect(index, rule)} >
+                    <span className="col s5"> <Code>{rule.match}</Code></span>
+                    <span className="col s2 center-align ">{rule.status || 302} →</span>
+                    <span className="col s5"> <Code>{rule.target}</Code></span>
+                    {rule.preserve_query && <span className="col s12"> preserves the query </span>}
+                </li>
+            }
+            )}
+        </ul>
+        <hr />
+        < NewRedirect />
+    </div>
+}
+
 class CreateService extends React.Component<{}, { name: string }> {
     constructor() {
         super()
@@ -212,6 +429,7 @@ function Binding({config}: { config: BindingConfig }) {
     return <dl>
         <dt> Scheme </dt> <dd> {config.scheme} </dd>
         <dt> Host </dt> <dd> {config.host} </dd>
+        <dt> Rewrite </dt> <dd> <Code>{config.rewrite}</Code> </dd>
         <dt> Headers </dt> <dd> <dl> {
             Object.keys(config.headers || {}).map(header => {
                 return [<dt> {header} </dt>, <dl> {config.headers[header]} </dl>]
@@ -238,6 +456,12 @@ class Byway extends React.Component<BywayConfig, { pageContent: (config: BywayCo
             })
         })
 
+        this.redirectPathBuilder = router.register("redirect", (r) => {
+            this.setState({
+                pageContent: (config) => this.redirects(config)
+            })
+        })
+
         router.register("", (_, r) => {
             var p = this.servicesPathBuilder({})
             nav.navTo(p)()
@@ -251,7 +475,14 @@ class Byway extends React.Component<BywayConfig, { pageContent: (config: BywayCo
     }
 
     rewrites(config) {
-        return <Rewrites rewrites={this.props.rewrites} />
+        return <div>
+            <Rewrites rewrites={this.props.rewrites} />
+            <RewriteRules rules={this.props.rewrite_rules || []} />
+        </div>
+    }
+
+    redirects(config) {
+        return <Redirects redirects={this.props.redirects || []} />
     }
 
     render() {
@@ -262,6 +493,7 @@ class Byway extends React.Component<BywayConfig, { pageContent: (config: BywayCo
                     <ul id="nav-mobile" className="left">
                         <li><a href="#" onClick={(e) => { e.preventDefault(); nav.navTo(this.servicesPathBuilder({}))() } }  >Services</a></li>
                         <li><a href="#" onClick={(e) => { e.preventDefault(); nav.navTo(this.rewritePathBuilder({}))() } }>Rewrite</a></li>
+                        <li><a href="#" onClick={(e) => { e.preventDefault(); nav.navTo(this.redirectPathBuilder({}))() } }>Redirect</a></li>
 
                     </ul>
                 </div>
@@ -277,6 +509,7 @@ class Byway extends React.Component<BywayConfig, { pageContent: (config: BywayCo
 
     private servicesPathBuilder: (any?) => string
     private rewritePathBuilder: (any?) => string
+    private redirectPathBuilder: (any?) => string
 }
 
 function refresh() {
@@ -5,17 +5,20 @@ import (
 
 	"github.com/amerdrix/byway/config"
 	"github.com/amerdrix/byway/core"
+	"github.com/amerdrix/byway/dns"
 )
 
 func main() {
 	fmt.Println("Welcome to byway darwin!")
 
 	config := make(chan *core.Config, 1)
+	exit := make(chan bool)
 
-	//bywayConfig.WatchRedis(config)
-	bywayConfig.WatchConfigFile(config)
+	//bywayConfig.WatchRedis(config, exit)
+	bywayConfig.WatchConfigFile(config, exit)
 
-	core.Init(bywayConfig.LogConfig(config))
-	exit := make(chan bool)
+	configs := bywayConfig.Broadcast(bywayConfig.LogConfig(config), 2)
+	core.Init(configs[0], exit)
+	bywayDNS.Init(configs[1], exit)
 	<-exit
 }
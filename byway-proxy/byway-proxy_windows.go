@@ -9,6 +9,7 @@ import (
 
 	"github.com/amerdrix/byway/config"
 	"github.com/amerdrix/byway/core"
+	"github.com/amerdrix/byway/dns"
 
 	"golang.org/x/sys/windows/svc"
 
@@ -28,7 +29,9 @@ func (m *bywayService) Execute(args []string, r <-chan svc.ChangeRequest, change
 	config := make(chan *core.Config, 1)
 	exit := make(chan bool)
 	bywayConfig.WatchRedis(config, exit)
-	core.Init(bywayConfig.LogConfig(config), exit)
+	configs := bywayConfig.Broadcast(bywayConfig.LogConfig(config), 2)
+	core.Init(configs[0], exit)
+	bywayDNS.Init(configs[1], exit)
 
 	changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
 
@@ -159,7 +162,9 @@ func main() {
 			config := make(chan *core.Config, 1)
 			exit := make(chan bool)
 			bywayConfig.WatchRedis(config, exit)
-			core.Init(bywayConfig.LogConfig(config), exit)
+			configs := bywayConfig.Broadcast(bywayConfig.LogConfig(config), 2)
+			core.Init(configs[0], exit)
+			bywayDNS.Init(configs[1], exit)
 
 			<-exit
 		}
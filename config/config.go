@@ -1,13 +1,16 @@
 package bywayConfig
 
 import (
-	"fmt"
+	"context"
+	"log/slog"
 
 	"gopkg.in/yaml.v2"
 
 	"github.com/amerdrix/byway/core"
 )
 
+var logger = core.Logger().With("component", "config")
+
 // LogConfig intercepts a chan and logs it
 func LogConfig(input chan *core.Config) chan *core.Config {
 	configWriter := make(chan *core.Config, 1)
@@ -15,11 +18,31 @@ func LogConfig(input chan *core.Config) chan *core.Config {
 		for {
 			table := <-input
 
-			loaded, _ := yaml.Marshal(table)
-			fmt.Printf("byway: config updated\n%s", loaded)
+			logger.Info("config updated")
+			if logger.Enabled(context.Background(), slog.LevelDebug) {
+				loaded, _ := yaml.Marshal(core.RedactSecrets(table))
+				logger.Debug("config", "yaml", string(loaded))
+			}
 
 			configWriter <- table
 		}
 	}()
 	return configWriter
 }
+
+// Broadcast fans a chan out to count chans which each receive every config
+func Broadcast(input chan *core.Config, count int) []chan *core.Config {
+	outputs := make([]chan *core.Config, count)
+	for i := range outputs {
+		outputs[i] = make(chan *core.Config, 1)
+	}
+	go func() {
+		for {
+			table := <-input
+			for _, output := range outputs {
+				output <- table
+			}
+		}
+	}()
+	return outputs
+}
@@ -3,7 +3,10 @@ package bywayConfig
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/amerdrix/byway/core"
 	"gopkg.in/redis.v5"
@@ -25,52 +28,90 @@ func withRedis(cb func(redis *redis.Client) error) error {
 
 	pong, err := redisClientSingleton.Ping().Result()
 	if err != nil {
-		log.Fatalf("byway: redis: %s\n", err)
+		logger.Error("could not connect to redis", "err", err)
+		os.Exit(1)
 	}
-	log.Printf("byway: redis: %s", pong)
+	logger.Info("connected to redis", "reply", pong)
+	core.UseRedis(redisClientSingleton)
 
 	return cb(redisClientSingleton)
 }
 
-func readRedisConfig(redis *redis.Client) *core.Config {
+func readRedisConfig(redis *redis.Client) (*core.Config, error) {
 	config := core.NewConfig()
 
 	rewriteMembers := redis.LRange("byway.rewrite", 0, -1)
 	if rewriteMembers.Err() != nil {
-		log.Fatalf("byway: redis: %s", rewriteMembers.Err())
+		return nil, rewriteMembers.Err()
 	}
-	log.Printf("byway: redis: %s\n", rewriteMembers)
 
 	for _, rewritePattern := range rewriteMembers.Val() {
 		config.Rewrites = append(config.Rewrites, core.RewriteConfigString(rewritePattern))
 	}
 
-	log.Printf("byway: rewrites: %s", config.Rewrites)
+	logger.Debug("read rewrites", "rewrites", config.Rewrites)
+
+	ruleMembers := redis.LRange("byway.rewrite_rule", 0, -1)
+	if ruleMembers.Err() != nil {
+		return nil, ruleMembers.Err()
+	}
+
+	for _, member := range ruleMembers.Val() {
+		rule := core.RewriteRuleConfig{}
+		err := json.Unmarshal([]byte(member), &rule)
+		if err != nil {
+			return nil, fmt.Errorf("byway.rewrite_rule: %s", err)
+		}
+		config.RewriteRules = append(config.RewriteRules, rule)
+	}
+
+	logger.Debug("read rewrite rules", "rules", ruleMembers.Val())
+
+	redirectMembers := redis.LRange("byway.redirect", 0, -1)
+	if redirectMembers.Err() != nil {
+		return nil, redirectMembers.Err()
+	}
+
+	for _, member := range redirectMembers.Val() {
+		rule := core.RedirectRuleConfig{}
+		err := json.Unmarshal([]byte(member), &rule)
+		if err != nil {
+			return nil, fmt.Errorf("byway.redirect: %s", err)
+		}
+		config.Redirects = append(config.Redirects, rule)
+	}
+
+	logger.Debug("read redirects", "rules", redirectMembers.Val())
+
+	grammarMembers := redis.LRange("byway.grammar", 0, -1)
+	if grammarMembers.Err() != nil {
+		return nil, grammarMembers.Err()
+	}
+	config.Grammars = append(config.Grammars, grammarMembers.Val()...)
 
 	indexName := "byway.service_index"
 	indexMembers := redis.SMembers(indexName)
 	if indexMembers.Err() != nil {
-		log.Fatalf("byway: redis: %s", indexMembers.Err())
+		return nil, indexMembers.Err()
 	}
-	log.Printf("byway: redis: %s\n", indexMembers)
+	logger.Debug("read service index", "services", indexMembers.Val())
 
 	for _, serviceName := range indexMembers.Val() {
 		versionTable := make(map[core.VersionString]core.EndpointConfig)
 
 		vtable := redis.HGetAll("byway.service." + serviceName)
 		if vtable.Err() != nil {
-			log.Fatalf("byway: redis: %s", vtable.Err())
+			return nil, vtable.Err()
 		}
-		log.Printf("byway: redis: %s\n", vtable)
 
 		for serviceVersion, endpoint := range vtable.Val() {
-			log.Printf("byway: redis: %s:%s \n", serviceVersion, endpoint)
+			logger.Debug("read binding", "service", serviceName, "version", serviceVersion)
 
 			ep := core.EndpointConfig{}
 
 			err := json.Unmarshal([]byte(endpoint), &ep)
 			if err != nil {
-				log.Fatalf("byway: redis: %s", err)
+				return nil, fmt.Errorf("byway.service.%s %s: %s", serviceName, serviceVersion, err)
 			}
 
 			versionTable[core.VersionString(serviceVersion)] = ep
@@ -82,7 +123,7 @@ func readRedisConfig(redis *redis.Client) *core.Config {
 	for _, key := range redis.Keys("byway.topology.*").Val() {
 		redisHash := redis.HGetAll(key)
 		if redisHash.Err() != nil {
-			log.Fatalf("byway: redis: %s", redisHash.Err())
+			return nil, redisHash.Err()
 		}
 
 		vTable := make(map[core.ServiceName]core.VersionString)
@@ -92,11 +133,155 @@ func readRedisConfig(redis *redis.Client) *core.Config {
 
 		config.Topologies[core.TopologyKey(key[15:len(key)])] = vTable
 
-		log.Printf("byway: redis: topology: %s, %s", key, vTable)
+		logger.Debug("read topology", "key", key, "versions", vTable)
+
+	}
+
+	dnsConfig := &core.DNSConfig{}
+	ok, err := readRedisJSON(redis, "byway.dns", dnsConfig)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		config.DNS = dnsConfig
+	}
+
+	proxyProtocolConfig := &core.ProxyProtocolConfig{}
+	ok, err = readRedisJSON(redis, "byway.proxy_protocol", proxyProtocolConfig)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		config.ProxyProtocol = proxyProtocolConfig
+	}
+
+	listeners := make(map[string]core.ListenerConfig)
+	ok, err = readRedisJSON(redis, "byway.listeners", &listeners)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		config.Listeners = listeners
+	}
+
+	routeCacheConfig := &core.RouteCacheConfig{}
+	ok, err = readRedisJSON(redis, "byway.route_cache", routeCacheConfig)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		config.RouteCache = routeCacheConfig
+	}
+
+	loggingConfig := &core.LoggingConfig{}
+	ok, err = readRedisJSON(redis, "byway.logging", loggingConfig)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		config.Logging = loggingConfig
+	}
+
+	accessLogConfig := &core.AccessLogConfig{}
+	ok, err = readRedisJSON(redis, "byway.access_log", accessLogConfig)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		config.AccessLog = accessLogConfig
+	}
+
+	adminConfig := &core.AdminConfig{}
+	ok, err = readRedisJSON(redis, "byway.admin", adminConfig)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		config.Admin = adminConfig
+	}
+
+	tracingConfig := &core.TracingConfig{}
+	ok, err = readRedisJSON(redis, "byway.tracing", tracingConfig)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		config.Tracing = tracingConfig
+	}
+
+	requestIDConfig := &core.RequestIDConfig{}
+	ok, err = readRedisJSON(redis, "byway.request_id", requestIDConfig)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		config.RequestID = requestIDConfig
+	}
+
+	forwardedConfig := &core.ForwardedConfig{}
+	ok, err = readRedisJSON(redis, "byway.forwarded", forwardedConfig)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		config.Forwarded = forwardedConfig
+	}
+
+	compressionConfig := &core.CompressionConfig{}
+	ok, err = readRedisJSON(redis, "byway.compression", compressionConfig)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		config.Compression = compressionConfig
+	}
+
+	cacheConfig := &core.CacheConfig{}
+	ok, err = readRedisJSON(redis, "byway.cache", cacheConfig)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		config.Cache = cacheConfig
+	}
+
+	rateLimitConfig := &core.RateLimitConfig{}
+	ok, err = readRedisJSON(redis, "byway.rate_limit", rateLimitConfig)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		config.RateLimit = rateLimitConfig
+	}
+
+	secrets := redis.HGetAll("byway.secrets")
+	if secrets.Err() != nil {
+		return nil, secrets.Err()
+	}
+	if len(secrets.Val()) > 0 {
+		config.Secrets = secrets.Val()
+	}
+
+	return config, nil
+}
 
+// readRedisJSON reads an optional json encoded key, reporting whether it was set
+func readRedisJSON(client *redis.Client, key string, target interface{}) (bool, error) {
+	value := client.Get(key)
+	if value.Err() == redis.Nil {
+		return false, nil
+	}
+	if value.Err() != nil {
+		return false, fmt.Errorf("%s: %s", key, value.Err())
+	}
+
+	err := json.Unmarshal([]byte(value.Val()), target)
+	if err != nil {
+		return false, fmt.Errorf("%s: %s", key, err)
 	}
+	logger.Debug("read key", "key", key)
 
-	return config
+	return true, nil
 }
 
 // CreateRewrite creates a rewrite rule
@@ -112,6 +297,111 @@ func CreateRewrite(rewrite core.RewriteConfigString) error {
 	})
 }
 
+// SetLogging stores the logging config every proxy applies
+func SetLogging(logging *core.LoggingConfig) error {
+	return withRedis(func(r *redis.Client) error {
+		encoded, err := json.Marshal(logging)
+		if err != nil {
+			return err
+		}
+
+		err = r.Set("byway.logging", string(encoded), 0).Err()
+		if err != nil {
+			return err
+		}
+
+		return r.Publish("byway.update", "go").Err()
+	})
+}
+
+// SetSecret stores a secret, encrypted by core.EncryptSecret, for header values to refer to
+func SetSecret(name string, ciphertext string) error {
+	return withRedis(func(r *redis.Client) error {
+		err := r.HSet("byway.secrets", name, ciphertext).Err()
+		if err != nil {
+			return err
+		}
+
+		return r.Publish("byway.update", "go").Err()
+	})
+}
+
+// PurgeCache removes the cached responses of a service, or of one version of
+// it, from every proxy
+func PurgeCache(serviceName core.ServiceName, version core.VersionString) error {
+	return withRedis(func(r *redis.Client) error {
+		id := strconv.FormatInt(time.Now().UnixNano(), 36)
+		return r.Publish("byway.purge", id+"/"+string(serviceName)+"/"+string(version)).Err()
+	})
+}
+
+// CreateRewriteRule creates a conditional rewrite rule
+func CreateRewriteRule(rule *core.RewriteRuleConfig) error {
+	return pushRedisJSON("byway.rewrite_rule", rule)
+}
+
+// RemoveRewriteRule removes the conditional rewrite rule at index
+func RemoveRewriteRule(index int64, rule *core.RewriteRuleConfig) error {
+	return removeRedisJSON("byway.rewrite_rule", index, rule)
+}
+
+// CreateRedirect creates a redirect rule
+func CreateRedirect(rule *core.RedirectRuleConfig) error {
+	return pushRedisJSON("byway.redirect", rule)
+}
+
+// RemoveRedirect removes the redirect rule at index
+func RemoveRedirect(index int64, rule *core.RedirectRuleConfig) error {
+	return removeRedisJSON("byway.redirect", index, rule)
+}
+
+// pushRedisJSON appends a json encoded value to a list
+func pushRedisJSON(key string, value interface{}) error {
+	return withRedis(func(r *redis.Client) error {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+
+		err = r.RPush(key, string(encoded)).Err()
+		if err != nil {
+			return err
+		}
+
+		return r.Publish("byway.update", "go").Err()
+	})
+}
+
+// removeRedisJSON removes the json encoded value at index of a list
+func removeRedisJSON(key string, index int64, value interface{}) error {
+	return withRedis(func(r *redis.Client) error {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+
+		get := r.LRange(key, index, -1)
+		if get.Err() != nil {
+			return get.Err()
+		}
+		val := get.Val()
+
+		if len(val) == 0 || val[0] != string(encoded) {
+			return fmt.Errorf("Rule (%s) at index (%d) does not match provided rule", val, index)
+		}
+		err = r.LSet(key, index, ":DEL:").Err()
+		if err != nil {
+			return err
+		}
+		err = r.LRem(key, 0, ":DEL:").Err()
+		if err != nil {
+			return err
+		}
+
+		return r.Publish("byway.update", "go").Err()
+	})
+}
+
 // CreateService creates an empty service
 func CreateService(seviceName core.ServiceName) error {
 
@@ -184,17 +474,30 @@ func RemoveRewrite(index int64, rewrite core.RewriteConfigString) error {
 
 // WatchRedis - reads config from redis into the provided channel
 func WatchRedis(channel chan *core.Config, exit chan bool) {
-	withRedis(func(redis *redis.Client) error {
-		subscription, err := redis.Subscribe("byway.update")
+	withRedis(func(r *redis.Client) error {
+		subscription, err := r.Subscribe("byway.update", "byway.purge")
 
 		if err != nil {
-			log.Fatalf("byway: redis: %s\n", err)
+			logger.Error("could not subscribe to config updates", "err", err)
+			os.Exit(1)
 		}
 
 		go func() {
 			for {
-				subscription.Receive()
-				channel <- readRedisConfig(redis)
+				received, _ := subscription.Receive()
+				if message, ok := received.(*redis.Message); ok && message.Channel == "byway.purge" {
+					parts := strings.SplitN(message.Payload, "/", 3)
+					if len(parts) == 3 {
+						core.PurgeCacheBroadcast(core.ServiceName(parts[1]), core.VersionString(parts[2]), parts[0])
+					}
+					continue
+				}
+				config, err := readRedisConfig(r)
+				if err != nil {
+					logger.Error("rejected config", "err", err)
+					continue
+				}
+				channel <- config
 			}
 		}()
 		return err
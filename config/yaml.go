@@ -2,7 +2,7 @@ package bywayConfig
 
 import (
 	"io/ioutil"
-	"log"
+	"os"
 
 	"gopkg.in/yaml.v2"
 
@@ -13,18 +13,20 @@ import (
 func WatchConfigFile(channel chan *core.Config, exit chan bool) {
 	configFile, err := ioutil.ReadFile("./conf.yml")
 	if err != nil {
-		log.Fatal(err)
+		logger.Error("could not read config file", "err", err)
+		os.Exit(1)
 	}
 
-	log.Println("byway: Loading config")
+	logger.Info("loading config", "file", "./conf.yml")
 	newConfig := core.NewConfig()
 
 	err = yaml.Unmarshal(configFile, &newConfig)
 	if err != nil {
-		log.Fatal(err)
+		logger.Error("could not parse config file", "err", err)
+		os.Exit(1)
 	}
 
-	log.Println("byway: Config loaded")
+	logger.Info("config loaded")
 
 	channel <- newConfig
 }
@@ -0,0 +1,370 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// AccessLogConfig - one line per request. Format is json, common, combined or
+// template, which executes Template against each entry. Output is stdout,
+// syslog or the path of a file, which is rotated once it reaches MaxSizeMB
+type AccessLogConfig struct {
+	Format     string `json:"format,omitempty" yaml:"format,omitempty"`
+	Template   string `json:"template,omitempty" yaml:"template,omitempty"`
+	Output     string `json:"output,omitempty" yaml:"output,omitempty"`
+	MaxSizeMB  int    `json:"max_size_mb,omitempty" yaml:"max_size_mb,omitempty"`
+	MaxBackups int    `json:"max_backups,omitempty" yaml:"max_backups,omitempty"`
+	SyslogTag  string `json:"syslog_tag,omitempty" yaml:"syslog_tag,omitempty"`
+}
+
+const (
+	defaultAccessLogMaxSizeMB  = 100
+	defaultAccessLogMaxBackups = 5
+	commonLogTimeFormat        = "02/Jan/2006:15:04:05 -0700"
+)
+
+// accessLogEntry - the fields of an access log line, templates refer to them by name
+type accessLogEntry struct {
+	Time      time.Time     `json:"time"`
+	RequestID string        `json:"request_id,omitempty"`
+	Client    string        `json:"client"`
+	User      string        `json:"user,omitempty"`
+	Method    string        `json:"method"`
+	Host      string        `json:"host"`
+	Path      string        `json:"path"`
+	Proto     string        `json:"proto"`
+	Listener  string        `json:"listener"`
+	Rewritten string        `json:"rewritten,omitempty"`
+	Service   ServiceName   `json:"service,omitempty"`
+	Version   VersionString `json:"version,omitempty"`
+	Topology  TopologyKey   `json:"topology,omitempty"`
+	Upstream  string        `json:"upstream,omitempty"`
+	Status    int           `json:"status"`
+	Bytes     int64         `json:"bytes"`
+	Latency   time.Duration `json:"-"`
+	LatencyMS float64       `json:"latency_ms"`
+	Referer   string        `json:"referer,omitempty"`
+	UserAgent string        `json:"user_agent,omitempty"`
+}
+
+type accessLogFormat func(buf *bytes.Buffer, entry *accessLogEntry) error
+
+// accessLog - a format and the output its lines are written to
+type accessLog struct {
+	config AccessLogConfig
+	format accessLogFormat
+	output io.WriteCloser
+	lock   sync.Mutex
+}
+
+// accessLogs - the access log of the live config, nil while disabled
+type accessLogs struct {
+	current atomic.Pointer[accessLog]
+}
+
+// apply replaces the access log when its config changed, closing the old output
+func (logs *accessLogs) apply(cfg *AccessLogConfig) error {
+	old := logs.current.Load()
+	if old != nil && cfg != nil && reflect.DeepEqual(old.config, *cfg) {
+		return nil
+	}
+	if old == nil && cfg == nil {
+		return nil
+	}
+
+	var next *accessLog
+	if cfg != nil {
+		var err error
+		next, err = newAccessLog(*cfg)
+		if err != nil {
+			return err
+		}
+	}
+	logs.current.Store(next)
+	if old != nil {
+		old.close()
+	}
+	return nil
+}
+
+func newAccessLogFormat(cfg AccessLogConfig) (accessLogFormat, error) {
+	switch cfg.Format {
+	case "", "json":
+		return formatJSON, nil
+	case "common":
+		return formatCommon, nil
+	case "combined":
+		return formatCombined, nil
+	case "template":
+		tmpl, err := template.New("access_log").Parse(cfg.Template)
+		if err != nil {
+			return nil, err
+		}
+		return func(buf *bytes.Buffer, entry *accessLogEntry) error {
+			return tmpl.Execute(buf, entry)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown format %s", cfg.Format)
+}
+
+func validateAccessLogConfig(cfg AccessLogConfig) error {
+	_, err := newAccessLogFormat(cfg)
+	return err
+}
+
+func newAccessLog(cfg AccessLogConfig) (*accessLog, error) {
+	format, err := newAccessLogFormat(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var output io.WriteCloser
+	switch cfg.Output {
+	case "", "stdout":
+		output = nopCloser{os.Stdout}
+	case "syslog":
+		tag := cfg.SyslogTag
+		if tag == "" {
+			tag = "byway"
+		}
+		output, err = newSyslogOutput(tag)
+	default:
+		maxSize, maxBackups := cfg.MaxSizeMB, cfg.MaxBackups
+		if maxSize == 0 {
+			maxSize = defaultAccessLogMaxSizeMB
+		}
+		if maxBackups == 0 {
+			maxBackups = defaultAccessLogMaxBackups
+		}
+		output, err = newRotatingFile(cfg.Output, int64(maxSize)<<20, maxBackups)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &accessLog{config: cfg, format: format, output: output}, nil
+}
+
+func (l *accessLog) write(entry *accessLogEntry) {
+	buf := &bytes.Buffer{}
+	err := l.format(buf, entry)
+	if err != nil {
+		logger.Warn("could not format access log", "err", err)
+		return
+	}
+	if buf.Len() == 0 || buf.Bytes()[buf.Len()-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	_, err = l.output.Write(buf.Bytes())
+	if err != nil {
+		logger.Warn("could not write access log", "err", err)
+	}
+}
+
+func (l *accessLog) close() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.output.Close()
+}
+
+func formatJSON(buf *bytes.Buffer, entry *accessLogEntry) error {
+	return json.NewEncoder(buf).Encode(entry)
+}
+
+func formatCommon(buf *bytes.Buffer, entry *accessLogEntry) error {
+	size := "-"
+	if entry.Bytes > 0 {
+		size = strconv.FormatInt(entry.Bytes, 10)
+	}
+	fmt.Fprintf(buf, "%s - %s [%s] \"%s %s %s\" %d %s",
+		entry.Client, orDash(entry.User), entry.Time.Format(commonLogTimeFormat),
+		entry.Method, entry.Path, entry.Proto, entry.Status, size)
+	return nil
+}
+
+func formatCombined(buf *bytes.Buffer, entry *accessLogEntry) error {
+	formatCommon(buf, entry)
+	fmt.Fprintf(buf, " %s %s", strconv.Quote(orDash(entry.Referer)), strconv.Quote(orDash(entry.UserAgent)))
+	return nil
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// withAccessLog writes a line for every request once it has been answered
+func withAccessLog(logs *accessLogs, inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		log := logs.current.Load()
+		if log == nil {
+			inner.ServeHTTP(w, req)
+			return
+		}
+
+		start := time.Now()
+		entry := &accessLogEntry{
+			Time:      start,
+			Client:    req.RemoteAddr,
+			Method:    req.Method,
+			Host:      req.Host,
+			Path:      req.URL.RequestURI(),
+			Proto:     req.Proto,
+			Referer:   req.Referer(),
+			UserAgent: req.UserAgent(),
+		}
+		if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			entry.Client = host
+		}
+		if user, _, ok := req.BasicAuth(); ok {
+			entry.User = user
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w}
+		inner.ServeHTTP(recorder, req)
+
+		route := routeFromContext(req.Context())
+		if route.clientIP != "" {
+			// the client behind any trusted proxies
+			entry.Client = route.clientIP
+		}
+		entry.Listener = route.listener
+		entry.RequestID = route.requestID
+		if route.rewritten != nil {
+			entry.Rewritten = route.rewritten.String()
+		}
+		entry.Topology = route.topology
+		if route.binding != nil {
+			entry.Service = route.binding.service
+			entry.Version = route.binding.version
+			entry.Upstream = route.binding.scheme + "://" + route.binding.host
+		}
+		entry.Status = recorder.status
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+		entry.Bytes = recorder.bytes
+		entry.Latency = time.Since(start)
+		entry.LatencyMS = float64(entry.Latency.Microseconds()) / 1000
+
+		log.write(entry)
+	})
+}
+
+// responseRecorder - counts the status and bytes of a response as it is written
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 && status >= http.StatusOK {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the flusher and hijacker beneath
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// rotatingFile - a log file which is renamed to path.1, path.2... once it
+// grows past maxSize, keeping maxBackups old files
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func newRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(b []byte) (int, error) {
+	if f.size > 0 && f.size+int64(len(b)) > f.maxSize {
+		err := f.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	for i := f.maxBackups - 1; i > 0; i-- {
+		os.Rename(backupName(f.path, i), backupName(f.path, i+1))
+	}
+	if f.maxBackups > 0 {
+		os.Rename(f.path, backupName(f.path, 1))
+	} else {
+		os.Remove(f.path)
+	}
+	return f.open()
+}
+
+func (f *rotatingFile) Close() error {
+	return f.file.Close()
+}
+
+func backupName(path string, index int) string {
+	return fmt.Sprintf("%s.%d", path, index)
+}
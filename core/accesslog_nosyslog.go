@@ -0,0 +1,12 @@
+//go:build windows || plan9
+
+package core
+
+import (
+	"errors"
+	"io"
+)
+
+func newSyslogOutput(tag string) (io.WriteCloser, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
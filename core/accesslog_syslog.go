@@ -0,0 +1,12 @@
+//go:build !windows && !plan9
+
+package core
+
+import (
+	"io"
+	"log/syslog"
+)
+
+func newSyslogOutput(tag string) (io.WriteCloser, error) {
+	return syslog.New(syslog.LOG_INFO|syslog.LOG_LOCAL0, tag)
+}
@@ -0,0 +1,249 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultMaxBufferedSize - the limit of bodies buffered without a configured size
+const defaultMaxBufferedSize = 16 << 20
+
+// BodyConfig - body handling of a binding. Requests over MaxRequestSize bytes
+// are answered with 413, 0 is unlimited. BufferRequest reads the whole request
+// before proxying it, which lets failed requests be retried, and
+// BufferResponse the whole response before answering, with 502 when it is over
+// MaxResponseSize bytes. Buffered bodies are limited to 16MiB unless a size is
+// set. FlushInterval, a duration or -1 for after every write, flushes
+// streamed responses such as server-sent events
+type BodyConfig struct {
+	MaxRequestSize  int64  `json:"max_request_size,omitempty" yaml:"max_request_size,omitempty"`
+	MaxResponseSize int64  `json:"max_response_size,omitempty" yaml:"max_response_size,omitempty"`
+	BufferRequest   bool   `json:"buffer_request,omitempty" yaml:"buffer_request,omitempty"`
+	BufferResponse  bool   `json:"buffer_response,omitempty" yaml:"buffer_response,omitempty"`
+	FlushInterval   string `json:"flush_interval,omitempty" yaml:"flush_interval,omitempty"`
+}
+
+type bodyPolicy struct {
+	maxRequestSize  int64
+	maxResponseSize int64
+	bufferRequest   bool
+	bufferResponse  bool
+	flushInterval   time.Duration
+}
+
+func mapBodyConfig(cfg *BodyConfig) (*bodyPolicy, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if cfg.MaxRequestSize < 0 {
+		return nil, fmt.Errorf("max_request_size must not be negative")
+	}
+	if cfg.MaxResponseSize < 0 {
+		return nil, fmt.Errorf("max_response_size must not be negative")
+	}
+
+	policy := &bodyPolicy{
+		maxRequestSize:  cfg.MaxRequestSize,
+		maxResponseSize: cfg.MaxResponseSize,
+		bufferRequest:   cfg.BufferRequest,
+		bufferResponse:  cfg.BufferResponse,
+	}
+	if policy.maxResponseSize == 0 {
+		policy.maxResponseSize = defaultMaxBufferedSize
+	}
+	if cfg.FlushInterval == "-1" {
+		policy.flushInterval = -1
+	} else if cfg.FlushInterval != "" {
+		interval, err := time.ParseDuration(cfg.FlushInterval)
+		if err != nil {
+			return nil, fmt.Errorf("flush_interval: %s", err)
+		}
+		if interval <= 0 {
+			return nil, fmt.Errorf("flush_interval must be positive, or -1")
+		}
+		policy.flushInterval = interval
+	}
+	return policy, nil
+}
+
+// streamed reports whether responses are flushed on an interval
+func (policy *bodyPolicy) streamed() bool {
+	return policy != nil && policy.flushInterval != 0
+}
+
+func requestTooLarge(limit int64) error {
+	return &routeError{http.StatusRequestEntityTooLarge, "request body exceeds " + strconv.FormatInt(limit, 10) + " bytes"}
+}
+
+// limitRequest applies the request size limit and buffering to req, an error
+// is a routeError to answer the client with
+func (policy *bodyPolicy) limitRequest(req *http.Request) error {
+	if policy == nil || req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	limit := policy.maxRequestSize
+	if limit > 0 && req.ContentLength > limit {
+		return requestTooLarge(limit)
+	}
+
+	if !policy.bufferRequest {
+		if limit > 0 {
+			req.Body = &limitedBody{ReadCloser: req.Body, limit: limit, remaining: limit}
+		}
+		return nil
+	}
+
+	if limit == 0 {
+		limit = defaultMaxBufferedSize
+		if req.ContentLength > limit {
+			return requestTooLarge(limit)
+		}
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, limit+1))
+	req.Body.Close()
+	if err != nil {
+		return &routeError{http.StatusBadRequest, fmt.Sprintf("could not read request body: %s", err)}
+	}
+	if int64(len(body)) > limit {
+		return requestTooLarge(limit)
+	}
+
+	req.ContentLength = int64(len(body))
+	req.TransferEncoding = nil
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return nil
+}
+
+// limitedBody - a streamed request body which fails once it exceeds limit
+type limitedBody struct {
+	io.ReadCloser
+	limit     int64
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, requestTooLarge(b.limit)
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return 0, requestTooLarge(b.limit)
+	}
+	return n, err
+}
+
+// readResponse buffers the whole of resp, so that upstream failures part way
+// through are answered with an error rather than a truncated response
+func (policy *bodyPolicy) readResponse(resp *http.Response) error {
+	if policy == nil || !policy.bufferResponse || resp.Body == nil || resp.Body == http.NoBody {
+		return nil
+	}
+	limit := policy.maxResponseSize
+	tooLarge := &routeError{http.StatusBadGateway, "response body exceeds " + strconv.FormatInt(limit, 10) + " bytes"}
+	if resp.ContentLength > limit {
+		resp.Body.Close()
+		return tooLarge
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > limit {
+		return tooLarge
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.TransferEncoding = nil
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// withFlushInterval flushes responses on the interval of the binding they
+// were routed to, once the binding is known
+func withFlushInterval(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writer := &flushWriter{ResponseWriter: w, route: routeFromContext(req.Context())}
+		defer writer.stop()
+		inner.ServeHTTP(writer, req)
+	})
+}
+
+// flushWriter - flushes after every write, or at most interval after a write
+type flushWriter struct {
+	http.ResponseWriter
+	route *route
+
+	lock    sync.Mutex
+	timer   *time.Timer
+	pending bool
+	stopped bool
+}
+
+func (w *flushWriter) interval() time.Duration {
+	if w.route.binding == nil || w.route.binding.body == nil {
+		return 0
+	}
+	return w.route.binding.body.flushInterval
+}
+
+func (w *flushWriter) Write(b []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	n, err := w.ResponseWriter.Write(b)
+	interval := w.interval()
+	if interval < 0 {
+		http.NewResponseController(w.ResponseWriter).Flush()
+	} else if interval > 0 && !w.pending {
+		w.pending = true
+		if w.timer == nil {
+			w.timer = time.AfterFunc(interval, w.delayedFlush)
+		} else {
+			w.timer.Reset(interval)
+		}
+	}
+	return n, err
+}
+
+func (w *flushWriter) delayedFlush() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.pending = false
+	if !w.stopped {
+		http.NewResponseController(w.ResponseWriter).Flush()
+	}
+}
+
+// FlushError serialises flushes asked for by the proxy with timed flushes
+func (w *flushWriter) FlushError() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *flushWriter) stop() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.stopped = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the hijacker beneath
+func (w *flushWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,157 @@
+package core
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func mustMapBodyConfig(t *testing.T, cfg *BodyConfig) *bodyPolicy {
+	t.Helper()
+	policy, err := mapBodyConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return policy
+}
+
+// statusOf - the status a routeError in err answers with, 0 without one
+func statusOf(err error) int {
+	var routeErr *routeError
+	if errors.As(err, &routeErr) {
+		return routeErr.status
+	}
+	return 0
+}
+
+func TestLimitRequest(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		cfg      BodyConfig
+		body     string
+		length   int64
+		rejected bool
+	}{
+		{"within the limit", BodyConfig{MaxRequestSize: 10}, "0123456789", 10, false},
+		{"Content-Length over the limit", BodyConfig{MaxRequestSize: 10}, "0123456789a", 11, true},
+		{"buffered within the limit", BodyConfig{MaxRequestSize: 10, BufferRequest: true}, "0123456789", -1, false},
+		{"buffered over the limit", BodyConfig{MaxRequestSize: 10, BufferRequest: true}, "0123456789a", -1, true},
+		{"buffered Content-Length over the default", BodyConfig{BufferRequest: true}, "", defaultMaxBufferedSize + 1, true},
+		{"unlimited", BodyConfig{}, strings.Repeat("a", 100), -1, false},
+	} {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(test.body))
+		req.ContentLength = test.length
+		err := mustMapBodyConfig(t, &test.cfg).limitRequest(req)
+		if test.rejected {
+			if status := statusOf(err); status != http.StatusRequestEntityTooLarge {
+				t.Errorf("%s: rejected with %v, expected 413", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		body, err := io.ReadAll(req.Body)
+		if err != nil || string(body) != test.body {
+			t.Errorf("%s: read %q, %v", test.name, body, err)
+		}
+		if test.cfg.BufferRequest && (req.ContentLength != int64(len(test.body)) || req.GetBody == nil) {
+			t.Errorf("%s: buffered body has length %d and GetBody %v", test.name, req.ContentLength, req.GetBody != nil)
+		}
+	}
+}
+
+func TestLimitedBodyFailsOnceOverTheLimit(t *testing.T) {
+	policy := mustMapBodyConfig(t, &BodyConfig{MaxRequestSize: 10})
+	for _, body := range []string{"0123456789", "0123456789a", strings.Repeat("a", 100)} {
+		req := httptest.NewRequest("POST", "/", iotest.OneByteReader(strings.NewReader(body)))
+		req.ContentLength = -1
+		if err := policy.limitRequest(req); err != nil {
+			t.Fatal(err)
+		}
+
+		read, err := io.ReadAll(req.Body)
+		if len(body) <= 10 {
+			if err != nil || string(read) != body {
+				t.Errorf("%d bytes: read %q, %v", len(body), read, err)
+			}
+		} else if status := statusOf(err); status != http.StatusRequestEntityTooLarge || len(read) > 10 {
+			t.Errorf("%d bytes: read %d bytes and failed with %v, expected 413 within 10 bytes", len(body), len(read), err)
+		}
+	}
+}
+
+func TestReadResponse(t *testing.T) {
+	policy := mustMapBodyConfig(t, &BodyConfig{BufferResponse: true, MaxResponseSize: 10})
+	for _, test := range []struct {
+		name     string
+		body     string
+		length   int64
+		rejected bool
+	}{
+		{"within the limit", "0123456789", -1, false},
+		{"over the limit", "0123456789a", -1, true},
+		{"Content-Length over the limit", "0123456789a", 11, true},
+	} {
+		resp := &http.Response{Header: http.Header{}, ContentLength: test.length, Body: io.NopCloser(strings.NewReader(test.body))}
+		err := policy.readResponse(resp)
+		if test.rejected {
+			if status := statusOf(err); status != http.StatusBadGateway {
+				t.Errorf("%s: rejected with %v, expected 502", test.name, err)
+			}
+			continue
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if err != nil || string(body) != test.body || resp.Header.Get("Content-Length") != "10" {
+			t.Errorf("%s: read %q with Content-Length %q, %v", test.name, body, resp.Header.Get("Content-Length"), err)
+		}
+	}
+}
+
+func TestBodyConfigErrors(t *testing.T) {
+	for _, cfg := range []BodyConfig{
+		{MaxRequestSize: -1},
+		{MaxResponseSize: -1},
+		{FlushInterval: "soon"},
+		{FlushInterval: "0s"},
+	} {
+		if _, err := mapBodyConfig(&cfg); err == nil {
+			t.Errorf("%+v: expected an error", cfg)
+		}
+	}
+	if policy := mustMapBodyConfig(t, &BodyConfig{FlushInterval: "-1"}); policy.flushInterval != -1 {
+		t.Errorf("flush_interval -1 mapped to %s", policy.flushInterval)
+	}
+}
+
+func TestBodyLimitsOfBindings(t *testing.T) {
+	limited := newProxyTest(t, EndpointConfig{Body: &BodyConfig{MaxRequestSize: 10}}, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	})
+	for name, length := range map[string]int64{"Content-Length": 11, "streamed": -1} {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(strings.Repeat("a", 64<<10)))
+		req.ContentLength = length
+		if resp := serveProxyTest(limited, req); resp.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s request over the limit answered %d", name, resp.Code)
+		}
+	}
+	req := httptest.NewRequest("POST", "/", strings.NewReader("0123456789"))
+	if resp := serveProxyTest(limited, req); resp.Code != http.StatusOK {
+		t.Errorf("request within the limit answered %d", resp.Code)
+	}
+
+	buffered := newProxyTest(t, EndpointConfig{Body: &BodyConfig{BufferResponse: true, MaxResponseSize: 10}}, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Query().Get("body"))
+	})
+	if resp := serveProxyTest(buffered, httptest.NewRequest("GET", "/?body=0123456789a", nil)); resp.Code != http.StatusBadGateway {
+		t.Errorf("response over the limit answered %d", resp.Code)
+	}
+	if resp := serveProxyTest(buffered, httptest.NewRequest("GET", "/?body=0123456789", nil)); resp.Code != http.StatusOK || resp.Body.String() != "0123456789" {
+		t.Errorf("response within the limit answered %d %q", resp.Code, resp.Body)
+	}
+}
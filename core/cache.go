@@ -0,0 +1,690 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/redis.v5"
+)
+
+const (
+	defaultCacheMaxSizeMB    = 64
+	defaultCacheMaxEntrySize = 1 << 20
+	// cacheValidatorRetention - how long past staleness entries with
+	// validators are kept, to be revalidated rather than fetched again
+	cacheValidatorRetention = 10 * time.Minute
+	maxCacheVariants        = 8
+	// cacheStoreCloseDelay - how long a replaced store is kept open for the
+	// requests and revalidations still using it
+	cacheStoreCloseDelay = time.Minute
+)
+
+// CacheConfig - the shared response cache used by bindings with Cache set.
+// Store is memory, an LRU of MaxSizeMB (64 by default), or redis at
+// RedisAddress. Responses over MaxEntrySize bytes (1MiB by default) are not stored
+type CacheConfig struct {
+	Store        string `json:"store,omitempty" yaml:"store,omitempty"`
+	MaxSizeMB    int64  `json:"max_size_mb,omitempty" yaml:"max_size_mb,omitempty"`
+	MaxEntrySize int64  `json:"max_entry_size,omitempty" yaml:"max_entry_size,omitempty"`
+	RedisAddress string `json:"redis_address,omitempty" yaml:"redis_address,omitempty"`
+	RedisDB      int    `json:"redis_db,omitempty" yaml:"redis_db,omitempty"`
+}
+
+// cacheableStatus - statuses which may be stored given explicit freshness
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// cacheRecord - the variants stored for a url, which differ by their Vary headers
+type cacheRecord struct {
+	Variants []*cacheEntry
+}
+
+// cacheEntry - a stored response and its freshness, RFC 9111 section 4.2
+type cacheEntry struct {
+	Status               int
+	Header               http.Header
+	Body                 []byte
+	Stored               time.Time
+	InitialAge           time.Duration
+	Lifetime             time.Duration
+	StaleWhileRevalidate time.Duration
+	MustRevalidate       bool
+	Vary                 []string
+	VaryValues           []string
+}
+
+// responseCache - the store of the live cache config, nil while disabled
+type responseCache struct {
+	current  atomic.Pointer[cacheState]
+	lock     sync.Mutex
+	inflight map[string]chan struct{}
+}
+
+type cacheState struct {
+	config       CacheConfig
+	store        cacheStore
+	maxEntrySize int64
+}
+
+var httpCache = &responseCache{inflight: make(map[string]chan struct{})}
+
+func validateCacheConfig(cfg CacheConfig) error {
+	switch cfg.Store {
+	case "", "memory":
+	case "redis":
+		if cfg.RedisAddress == "" {
+			return fmt.Errorf("redis_address is required")
+		}
+	default:
+		return fmt.Errorf("unknown store %s", cfg.Store)
+	}
+	if cfg.MaxSizeMB < 0 || cfg.MaxEntrySize < 0 {
+		return fmt.Errorf("sizes must not be negative")
+	}
+	return nil
+}
+
+// apply replaces the store when the cache config changed
+func (c *responseCache) apply(cfg *CacheConfig) {
+	old := c.current.Load()
+	if old != nil && cfg != nil && reflect.DeepEqual(old.config, *cfg) {
+		return
+	}
+	if old == nil && cfg == nil {
+		return
+	}
+
+	var next *cacheState
+	if cfg != nil {
+		next = &cacheState{config: *cfg, maxEntrySize: cfg.MaxEntrySize}
+		if next.maxEntrySize == 0 {
+			next.maxEntrySize = defaultCacheMaxEntrySize
+		}
+		if cfg.Store == "redis" {
+			next.store = &redisCacheStore{redis.NewClient(&redis.Options{Addr: cfg.RedisAddress, DB: cfg.RedisDB})}
+		} else {
+			maxSize := cfg.MaxSizeMB
+			if maxSize == 0 {
+				maxSize = defaultCacheMaxSizeMB
+			}
+			next.store = newMemoryCacheStore(maxSize << 20)
+		}
+	}
+	c.current.Store(next)
+	if old != nil {
+		time.AfterFunc(cacheStoreCloseDelay, old.store.close)
+	}
+}
+
+func cachePrefix(service ServiceName, version VersionString) string {
+	prefix := "byway.cache." + string(service) + "/"
+	if version != "" {
+		prefix += string(version) + "/"
+	}
+	return prefix
+}
+
+// PurgeCache - removes the cached responses of a service, or of one version
+// of it when version is set
+func PurgeCache(service ServiceName, version VersionString) {
+	state := httpCache.current.Load()
+	if state == nil {
+		return
+	}
+	logger.Info("purging cache", "service", service, "version", version)
+	state.store.purge(cachePrefix(service, version))
+}
+
+// PurgeCacheBroadcast - PurgeCache for a purge broadcast to every proxy as
+// id. A store shared between proxies is purged by only one of them
+func PurgeCacheBroadcast(service ServiceName, version VersionString, id string) {
+	state := httpCache.current.Load()
+	if state == nil || !state.store.claim(id) {
+		return
+	}
+	logger.Info("purging cache", "service", service, "version", version, "id", id)
+	state.store.purge(cachePrefix(service, version))
+}
+
+// cacheKey - responses of different bindings, topologies or public hosts
+// are never shared
+func cacheKey(route *route, req *http.Request) string {
+	return cachePrefix(route.binding.service, route.binding.version) +
+		string(route.topology) + "/" + route.host + " " + req.URL.RequestURI()
+}
+
+type cacheControl map[string]string
+
+func parseCacheControl(values []string) cacheControl {
+	directives := cacheControl{}
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			name, argument, _ := strings.Cut(strings.TrimSpace(part), "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != "" {
+				directives[name] = strings.Trim(strings.TrimSpace(argument), `"`)
+			}
+		}
+	}
+	return directives
+}
+
+func (directives cacheControl) has(name string) bool {
+	_, ok := directives[name]
+	return ok
+}
+
+func (directives cacheControl) seconds(name string) (time.Duration, bool) {
+	value, ok := directives[name]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// roundTrip answers req from the cache when it can, otherwise from next,
+// storing what it may
+func (c *responseCache) roundTrip(req *http.Request, route *route, next func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	state := c.current.Load()
+	if state == nil {
+		return next(req)
+	}
+	key := cacheKey(route, req)
+
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		resp, err := next(req)
+		if err == nil && resp.StatusCode < http.StatusBadRequest && req.Method != http.MethodOptions && req.Method != http.MethodTrace {
+			// unsafe methods invalidate the url, RFC 9111 section 4.4
+			state.store.delete(key)
+		}
+		if err == nil {
+			resp.Header.Set("Cache-Status", "byway; fwd=method")
+		}
+		return resp, err
+	}
+
+	requestDirectives := parseCacheControl(req.Header.Values("Cache-Control"))
+	if requestDirectives.has("no-store") {
+		return c.forward(state, key, req, route, next, false, "request")
+	}
+	maxAge, hasMaxAge := requestDirectives.seconds("max-age")
+	lookup := !requestDirectives.has("no-cache") && !(hasMaxAge && maxAge == 0) &&
+		!strings.Contains(strings.ToLower(req.Header.Get("Pragma")), "no-cache")
+	if !lookup {
+		return c.forward(state, key, req, route, next, true, "request")
+	}
+
+	now := time.Now()
+	if entry := state.store.get(key).match(req); entry != nil {
+		age := entry.age(now)
+		if age < entry.Lifetime {
+			metrics.cacheRequests.WithLabelValues("hit").Inc()
+			return entry.response(req, age, "byway; hit"), nil
+		}
+		if !entry.MustRevalidate && age < entry.Lifetime+entry.StaleWhileRevalidate {
+			metrics.cacheRequests.WithLabelValues("stale").Inc()
+			c.revalidateInBackground(state, key, entry, req, route, next)
+			return entry.response(req, age, fmt.Sprintf("byway; hit; ttl=%d", int((entry.Lifetime-age)/time.Second))), nil
+		}
+		return c.revalidate(state, key, entry, req, route, next)
+	}
+	if requestDirectives.has("only-if-cached") {
+		return gatewayTimeout(req), nil
+	}
+
+	// coalesce misses, one request fetches and the rest wait for what it stores
+	wait, leader := c.join(key)
+	if !leader {
+		select {
+		case <-wait:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		if entry := state.store.get(key).match(req); entry != nil && entry.age(time.Now()) < entry.Lifetime {
+			metrics.cacheRequests.WithLabelValues("hit").Inc()
+			return entry.response(req, entry.age(time.Now()), "byway; hit; collapsed"), nil
+		}
+		return c.forward(state, key, req, route, next, true, "miss")
+	}
+	return c.fetch(state, key, req, route, next, func() { c.leave(key) }, "miss")
+}
+
+func (c *responseCache) join(key string) (chan struct{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if wait, ok := c.inflight[key]; ok {
+		return wait, false
+	}
+	c.inflight[key] = make(chan struct{})
+	return nil, true
+}
+
+func (c *responseCache) leave(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if wait, ok := c.inflight[key]; ok {
+		close(wait)
+		delete(c.inflight, key)
+	}
+}
+
+func (c *responseCache) forward(state *cacheState, key string, req *http.Request, route *route, next func(*http.Request) (*http.Response, error), store bool, reason string) (*http.Response, error) {
+	if !store {
+		metrics.cacheRequests.WithLabelValues("bypass").Inc()
+		resp, err := next(req)
+		if err == nil {
+			resp.Header.Set("Cache-Status", "byway; fwd="+reason)
+		}
+		return resp, err
+	}
+	return c.fetch(state, key, req, route, next, func() {}, reason)
+}
+
+// fetch forwards req and stores the response, calling done once it is stored or not storable
+func (c *responseCache) fetch(state *cacheState, key string, req *http.Request, route *route, next func(*http.Request) (*http.Response, error), done func(), reason string) (*http.Response, error) {
+	metrics.cacheRequests.WithLabelValues("miss").Inc()
+	resp, err := next(req)
+	if err != nil {
+		done()
+		return nil, err
+	}
+
+	status := "byway; fwd=" + reason
+	entry := newCacheEntry(resp, req, route, time.Now())
+	if entry == nil || resp.ContentLength > state.maxEntrySize {
+		done()
+		resp.Header.Set("Cache-Status", status)
+		return resp, nil
+	}
+	resp.Header.Set("Cache-Status", status+"; stored")
+	resp.Body = &cachingBody{ReadCloser: resp.Body, limit: state.maxEntrySize, finish: func(body []byte) {
+		if body != nil {
+			entry.Body = body
+			c.store(state, key, entry)
+		}
+		done()
+	}}
+	return resp, nil
+}
+
+// revalidate asks the upstream whether a stale entry is still current, RFC 9111 section 4.3
+func (c *responseCache) revalidate(state *cacheState, key string, entry *cacheEntry, req *http.Request, route *route, next func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	conditional := req.Header.Get("If-None-Match") == "" && req.Header.Get("If-Modified-Since") == ""
+	if conditional {
+		if etag := entry.Header.Get("ETag"); etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if modified := entry.Header.Get("Last-Modified"); modified != "" {
+			req.Header.Set("If-Modified-Since", modified)
+		}
+	}
+
+	resp, err := next(req)
+	if err != nil {
+		return nil, err
+	}
+	if conditional && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		updated := entry.refresh(resp, time.Now())
+		c.store(state, key, updated)
+		metrics.cacheRequests.WithLabelValues("revalidated").Inc()
+		req.Header.Del("If-None-Match")
+		req.Header.Del("If-Modified-Since")
+		return updated.response(req, updated.age(time.Now()), "byway; fwd=stale; fwd-status=304"), nil
+	}
+
+	metrics.cacheRequests.WithLabelValues("miss").Inc()
+	updated := newCacheEntry(resp, req, route, time.Now())
+	if updated == nil || resp.ContentLength > state.maxEntrySize {
+		resp.Header.Set("Cache-Status", "byway; fwd=stale")
+		return resp, nil
+	}
+	resp.Header.Set("Cache-Status", "byway; fwd=stale; stored")
+	resp.Body = &cachingBody{ReadCloser: resp.Body, limit: state.maxEntrySize, finish: func(body []byte) {
+		if body != nil {
+			updated.Body = body
+			c.store(state, key, updated)
+		}
+	}}
+	return resp, nil
+}
+
+// revalidateInBackground refreshes an entry served stale, once at a time per key
+func (c *responseCache) revalidateInBackground(state *cacheState, key string, entry *cacheEntry, req *http.Request, route *route, next func(*http.Request) (*http.Response, error)) {
+	_, leader := c.join(key)
+	if !leader {
+		return
+	}
+	background := req.Clone(context.WithoutCancel(req.Context()))
+	background.Method = http.MethodGet
+	background.Header.Del("If-None-Match")
+	background.Header.Del("If-Modified-Since")
+	go func() {
+		defer c.leave(key)
+		resp, err := c.revalidate(state, key, entry, background, route, next)
+		if err != nil {
+			logger.DebugContext(background.Context(), "background revalidation failed", "err", err)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+}
+
+// store adds entry to the record of key, replacing any variant it matches
+func (c *responseCache) store(state *cacheState, key string, entry *cacheEntry) {
+	record := &cacheRecord{Variants: []*cacheEntry{entry}}
+	if existing := state.store.get(key); existing != nil {
+		for _, variant := range existing.Variants {
+			if len(record.Variants) < maxCacheVariants && !variant.sameVariant(entry) {
+				record.Variants = append(record.Variants, variant)
+			}
+		}
+	}
+
+	ttl := time.Duration(0)
+	for _, variant := range record.Variants {
+		if variantTTL := variant.ttl(); variantTTL > ttl {
+			ttl = variantTTL
+		}
+	}
+	state.store.set(key, record, ttl)
+}
+
+// newCacheEntry - the entry to store resp as, or nil when it may not be
+// stored, RFC 9111 section 3
+func newCacheEntry(resp *http.Response, req *http.Request, route *route, now time.Time) *cacheEntry {
+	if req.Method != http.MethodGet || !cacheableStatus[resp.StatusCode] {
+		return nil
+	}
+	directives := parseCacheControl(resp.Header.Values("Cache-Control"))
+	if directives.has("no-store") || directives.has("private") || directives.has("no-cache") {
+		return nil
+	}
+	if len(resp.Header.Values("Set-Cookie")) > 0 {
+		return nil
+	}
+	if route.authorized && !directives.has("public") && !directives.has("s-maxage") && !directives.has("must-revalidate") {
+		return nil
+	}
+
+	vary := varyHeaders(resp.Header)
+	for _, name := range vary {
+		if name == "*" {
+			return nil
+		}
+	}
+
+	entry := &cacheEntry{
+		Status:         resp.StatusCode,
+		Header:         resp.Header.Clone(),
+		Stored:         now,
+		MustRevalidate: directives.has("must-revalidate") || directives.has("proxy-revalidate"),
+		Vary:           vary,
+		VaryValues:     varyValues(vary, req.Header),
+	}
+	entry.Header.Del("Cache-Status")
+	entry.Header.Del("Age")
+	entry.setFreshness(resp.Header, now)
+	if entry.Lifetime <= 0 && entry.StaleWhileRevalidate <= 0 && !entry.hasValidators() {
+		return nil
+	}
+	return entry
+}
+
+// setFreshness computes the lifetime and initial age of the entry from header
+func (entry *cacheEntry) setFreshness(header http.Header, now time.Time) {
+	directives := parseCacheControl(header.Values("Cache-Control"))
+	date, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		date = now
+	}
+
+	if lifetime, ok := directives.seconds("s-maxage"); ok {
+		entry.Lifetime = lifetime
+	} else if lifetime, ok := directives.seconds("max-age"); ok {
+		entry.Lifetime = lifetime
+	} else if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+		entry.Lifetime = expires.Sub(date)
+	} else {
+		entry.Lifetime = 0
+	}
+	entry.StaleWhileRevalidate, _ = directives.seconds("stale-while-revalidate")
+
+	apparentAge := now.Sub(date)
+	if apparentAge < 0 {
+		apparentAge = 0
+	}
+	ageValue := time.Duration(0)
+	if seconds, err := strconv.ParseInt(header.Get("Age"), 10, 64); err == nil && seconds > 0 {
+		ageValue = time.Duration(seconds) * time.Second
+	}
+	entry.InitialAge = apparentAge
+	if ageValue > apparentAge {
+		entry.InitialAge = ageValue
+	}
+}
+
+func (entry *cacheEntry) hasValidators() bool {
+	return entry.Header.Get("ETag") != "" || entry.Header.Get("Last-Modified") != ""
+}
+
+func (entry *cacheEntry) age(now time.Time) time.Duration {
+	return entry.InitialAge + now.Sub(entry.Stored)
+}
+
+// ttl - how long the store should keep the entry
+func (entry *cacheEntry) ttl() time.Duration {
+	ttl := entry.Lifetime + entry.StaleWhileRevalidate - entry.InitialAge
+	if entry.hasValidators() {
+		ttl += cacheValidatorRetention
+	}
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	return ttl
+}
+
+// refresh - a copy of the entry updated by a 304 response, RFC 9111 section 4.3.4
+func (entry *cacheEntry) refresh(resp *http.Response, now time.Time) *cacheEntry {
+	updated := *entry
+	updated.Header = entry.Header.Clone()
+	for name, values := range resp.Header {
+		switch name {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding", "Content-Range", "Cache-Status", "Age":
+			continue
+		}
+		updated.Header[name] = values
+	}
+	updated.Stored = now
+	updated.setFreshness(updated.Header, now)
+	directives := parseCacheControl(updated.Header.Values("Cache-Control"))
+	updated.MustRevalidate = directives.has("must-revalidate") || directives.has("proxy-revalidate")
+	return &updated
+}
+
+func (entry *cacheEntry) sameVariant(other *cacheEntry) bool {
+	return reflect.DeepEqual(entry.Vary, other.Vary) && reflect.DeepEqual(entry.VaryValues, other.VaryValues)
+}
+
+// match - the variant of the record req may be answered with
+func (record *cacheRecord) match(req *http.Request) *cacheEntry {
+	if record == nil {
+		return nil
+	}
+	for _, variant := range record.Variants {
+		if reflect.DeepEqual(variant.VaryValues, varyValues(variant.Vary, req.Header)) {
+			return variant
+		}
+	}
+	return nil
+}
+
+func (record *cacheRecord) size() int64 {
+	size := int64(0)
+	for _, variant := range record.Variants {
+		size += int64(len(variant.Body))
+		for name, values := range variant.Header {
+			size += int64(len(name))
+			for _, value := range values {
+				size += int64(len(value))
+			}
+		}
+	}
+	return size
+}
+
+// response - the entry as a response to req
+func (entry *cacheEntry) response(req *http.Request, age time.Duration, status string) *http.Response {
+	resp := &http.Response{
+		Status:     fmt.Sprintf("%d %s", entry.Status, http.StatusText(entry.Status)),
+		StatusCode: entry.Status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     entry.Header.Clone(),
+		Request:    req,
+	}
+	resp.Header.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	resp.Header.Set("Cache-Status", status)
+
+	if etag := entry.Header.Get("ETag"); etag != "" && matchesETag(req.Header.Get("If-None-Match"), etag) {
+		resp.StatusCode = http.StatusNotModified
+		resp.Status = fmt.Sprintf("%d %s", http.StatusNotModified, http.StatusText(http.StatusNotModified))
+		resp.Header.Del("Content-Length")
+		resp.Body = http.NoBody
+		return resp
+	}
+
+	resp.ContentLength = int64(len(entry.Body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(entry.Body)))
+	if req.Method == http.MethodHead {
+		resp.Body = http.NoBody
+	} else {
+		resp.Body = io.NopCloser(bytes.NewReader(entry.Body))
+	}
+	return resp
+}
+
+// matchesETag - the weak comparison of If-None-Match, RFC 9110 section 13.1.2
+func matchesETag(ifNoneMatch string, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func gatewayTimeout(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:     "504 Gateway Timeout",
+		StatusCode: http.StatusGatewayTimeout,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Cache-Status": {"byway; fwd=miss"}},
+		Body:       http.NoBody,
+		Request:    req,
+	}
+}
+
+func varyHeaders(header http.Header) []string {
+	var names []string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+func varyValues(names []string, header http.Header) []string {
+	if len(names) == 0 {
+		return nil
+	}
+	values := make([]string, len(names))
+	for i, name := range names {
+		values[i] = strings.Join(header.Values(name), ",")
+	}
+	return values
+}
+
+// cachingBody - keeps a copy of a body of up to limit bytes as it is read,
+// and hands it to finish at the end, or nil if it was cut short or too large
+type cachingBody struct {
+	io.ReadCloser
+	limit    int64
+	buffer   bytes.Buffer
+	overflow bool
+	finish   func([]byte)
+	finished bool
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.overflow {
+		if int64(b.buffer.Len()+n) > b.limit {
+			b.overflow = true
+			b.buffer = bytes.Buffer{}
+		} else {
+			b.buffer.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		b.complete(!b.overflow)
+	} else if err != nil {
+		b.complete(false)
+	}
+	return n, err
+}
+
+func (b *cachingBody) complete(ok bool) {
+	if b.finished {
+		return
+	}
+	b.finished = true
+	if ok {
+		// never nil, which would mean the body was not read
+		b.finish(append([]byte{}, b.buffer.Bytes()...))
+	} else {
+		b.finish(nil)
+	}
+}
+
+func (b *cachingBody) Close() error {
+	b.complete(false)
+	return b.ReadCloser.Close()
+}
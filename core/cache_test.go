@@ -0,0 +1,277 @@
+package core
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// cacheTest - a proxy caching the responses of one upstream, counting the
+// requests which reach it
+type cacheTest struct {
+	t        *testing.T
+	handler  http.Handler
+	requests atomic.Int64
+}
+
+func newCacheTest(t *testing.T, upstream http.HandlerFunc) *cacheTest {
+	test := &cacheTest{t: t}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		test.requests.Add(1)
+		upstream(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	rawConfig := NewConfig()
+	rawConfig.Mapping["echo"] = map[VersionString]EndpointConfig{
+		"1.0.0": {Host: strings.TrimPrefix(server.URL, "http://"), Scheme: "http", Cache: true},
+	}
+	rawConfig.Cache = &CacheConfig{}
+	config, err := mapConfig(rawConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// as Init does, so routes resolved by other tests are not reused
+	resolutionCache.reset(routeCacheSize(nil))
+	httpCache.apply(nil)
+	httpCache.apply(rawConfig.Cache)
+	t.Cleanup(func() {
+		// background revalidations would otherwise hold keys of the next test
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			httpCache.lock.Lock()
+			inflight := len(httpCache.inflight)
+			httpCache.lock.Unlock()
+			if inflight == 0 {
+				break
+			}
+		}
+		httpCache.apply(nil)
+	})
+
+	state := newProxyState()
+	state.current.Store(config)
+	test.handler = withRoute(defaultListenerName, newBywayHandler(state))
+	return test
+}
+
+func (test *cacheTest) do(method string, path string, header http.Header) *http.Response {
+	req := httptest.NewRequest(method, "http://1-0-0.1-0-0.echo.example.com"+path, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	recorder := httptest.NewRecorder()
+	test.handler.ServeHTTP(recorder, req)
+	return recorder.Result()
+}
+
+func (test *cacheTest) get(path string, header http.Header) (*http.Response, string) {
+	resp := test.do(http.MethodGet, path, header)
+	body, _ := io.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+func (test *cacheTest) expectRequests(expected int64) {
+	test.t.Helper()
+	if requests := test.requests.Load(); requests != expected {
+		test.t.Errorf("upstream received %d requests, expected %d", requests, expected)
+	}
+}
+
+func TestCacheServesFreshResponses(t *testing.T) {
+	test := newCacheTest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		io.WriteString(w, "fresh")
+	})
+
+	resp, body := test.get("/", nil)
+	if body != "fresh" || !strings.Contains(resp.Header.Get("Cache-Status"), "stored") {
+		t.Errorf("miss answered %q with Cache-Status %q", body, resp.Header.Get("Cache-Status"))
+	}
+	resp, body = test.get("/", nil)
+	if body != "fresh" || resp.Header.Get("Cache-Status") != "byway; hit" || resp.Header.Get("Age") == "" {
+		t.Errorf("hit answered %q with Cache-Status %q and Age %q", body, resp.Header.Get("Cache-Status"), resp.Header.Get("Age"))
+	}
+	resp, _ = test.get("/", http.Header{"If-None-Match": {`"v1"`}})
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("matching If-None-Match answered %d, expected 304", resp.StatusCode)
+	}
+	resp = test.do(http.MethodHead, "/", nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Cache-Status") != "byway; hit" {
+		t.Errorf("HEAD answered %d with Cache-Status %q", resp.StatusCode, resp.Header.Get("Cache-Status"))
+	}
+	test.expectRequests(1)
+
+	_, body = test.get("/", http.Header{"Cache-Control": {"no-cache"}})
+	if body != "fresh" {
+		t.Errorf("no-cache answered %q", body)
+	}
+	test.expectRequests(2)
+}
+
+func TestCacheDoesNotStorePrivateResponses(t *testing.T) {
+	test := newCacheTest(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		case "/cookie":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Set-Cookie", "session=1")
+		case "/public":
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		default:
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+	})
+
+	for _, path := range []string{"/no-store", "/private", "/cookie"} {
+		test.requests.Store(0)
+		test.get(path, nil)
+		test.get(path, nil)
+		test.expectRequests(2)
+	}
+
+	// responses to requests with Authorization are only shared when marked so
+	authorization := http.Header{"Authorization": {"Bearer token"}}
+	test.requests.Store(0)
+	test.get("/authorized", authorization)
+	test.get("/authorized", authorization)
+	test.expectRequests(2)
+
+	test.requests.Store(0)
+	test.get("/public", authorization)
+	test.get("/public", authorization)
+	test.expectRequests(1)
+}
+
+func TestCacheStoresVariants(t *testing.T) {
+	test := newCacheTest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		io.WriteString(w, "lang="+r.Header.Get("Accept-Language"))
+	})
+
+	for _, language := range []string{"en", "fr", "en", "fr"} {
+		_, body := test.get("/", http.Header{"Accept-Language": {language}})
+		if body != "lang="+language {
+			t.Errorf("Accept-Language %s answered %q", language, body)
+		}
+	}
+	test.expectRequests(2)
+}
+
+func TestCacheRefreshesNotModifiedResponses(t *testing.T) {
+	var conditional atomic.Int64
+	test := newCacheTest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=0, must-revalidate")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			conditional.Add(1)
+			w.Header().Set("X-Refreshed", "yes")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		io.WriteString(w, "body")
+	})
+
+	test.get("/", nil)
+	resp, body := test.get("/", nil)
+	if resp.StatusCode != http.StatusOK || body != "body" {
+		t.Errorf("revalidated response answered %d %q", resp.StatusCode, body)
+	}
+	if !strings.Contains(resp.Header.Get("Cache-Status"), "fwd-status=304") || resp.Header.Get("X-Refreshed") != "yes" {
+		t.Errorf("revalidated response was not refreshed from the 304: %v", resp.Header)
+	}
+	if conditional.Load() != 1 {
+		t.Errorf("upstream received %d conditional requests, expected 1", conditional.Load())
+	}
+}
+
+func TestCacheServesStaleWhileRevalidating(t *testing.T) {
+	var version atomic.Int64
+	revalidated := make(chan struct{}, 1)
+	test := newCacheTest(t, func(w http.ResponseWriter, r *http.Request) {
+		// already older than max-age, but within stale-while-revalidate
+		w.Header().Set("Cache-Control", "max-age=1, stale-while-revalidate=60")
+		w.Header().Set("Age", "5")
+		io.WriteString(w, "v"+string(rune('0'+version.Add(1))))
+		if version.Load() > 1 {
+			select {
+			case revalidated <- struct{}{}:
+			default:
+			}
+		}
+	})
+
+	test.get("/", nil)
+	resp, body := test.get("/", nil)
+	if body != "v1" || !strings.HasPrefix(resp.Header.Get("Cache-Status"), "byway; hit") {
+		t.Errorf("stale response answered %q with Cache-Status %q", body, resp.Header.Get("Cache-Status"))
+	}
+	select {
+	case <-revalidated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stale response was not revalidated in the background")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for body == "v1" && time.Now().Before(deadline) {
+		_, body = test.get("/", nil)
+	}
+	if body == "v1" {
+		t.Errorf("revalidated response was not stored, answered %q", body)
+	}
+}
+
+func TestCacheCoalescesMisses(t *testing.T) {
+	test := newCacheTest(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, "slow")
+	})
+
+	var wait sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			if _, body := test.get("/", nil); body != "slow" {
+				t.Errorf("coalesced request answered %q", body)
+			}
+		}()
+	}
+	wait.Wait()
+	test.expectRequests(1)
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	test := newCacheTest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+	})
+
+	test.get("/", nil)
+	PurgeCache("echo", "1.0.0")
+	test.get("/", nil)
+	test.expectRequests(2)
+
+	test.get("/", nil)
+	PurgeCache("echo", "")
+	test.get("/", nil)
+	test.expectRequests(3)
+
+	PurgeCache("other", "")
+	test.get("/", nil)
+	test.expectRequests(3)
+
+	// unsafe methods invalidate the url
+	test.do(http.MethodPost, "/", nil)
+	test.get("/", nil)
+	test.expectRequests(5)
+}
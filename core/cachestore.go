@@ -0,0 +1,191 @@
+package core
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/gob"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/redis.v5"
+)
+
+// cacheStore - where cached responses are kept. Records are not modified
+// once stored, a changed record is stored again
+type cacheStore interface {
+	get(key string) *cacheRecord
+	set(key string, record *cacheRecord, ttl time.Duration)
+	delete(key string)
+	purge(prefix string)
+	// claim reports whether this proxy is the first to handle the purge
+	// broadcast as id, and should purge a store shared between proxies
+	claim(id string) bool
+	close()
+}
+
+// memoryCacheStore - an LRU of records, bounded by their size in bytes
+type memoryCacheStore struct {
+	lock    sync.Mutex
+	maxSize int64
+	size    int64
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type memoryCacheItem struct {
+	key     string
+	record  *cacheRecord
+	size    int64
+	expires time.Time
+}
+
+func newMemoryCacheStore(maxSize int64) *memoryCacheStore {
+	return &memoryCacheStore{
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (s *memoryCacheStore) get(key string) *cacheRecord {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	element, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	item := element.Value.(*memoryCacheItem)
+	if time.Now().After(item.expires) {
+		s.remove(element)
+		return nil
+	}
+	s.order.MoveToFront(element)
+	return item.record
+}
+
+func (s *memoryCacheStore) set(key string, record *cacheRecord, ttl time.Duration) {
+	size := record.size() + int64(len(key))
+	if size > s.maxSize {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if element, ok := s.entries[key]; ok {
+		s.remove(element)
+	}
+	s.entries[key] = s.order.PushFront(&memoryCacheItem{key: key, record: record, size: size, expires: time.Now().Add(ttl)})
+	s.size += size
+	for s.size > s.maxSize {
+		s.remove(s.order.Back())
+	}
+}
+
+func (s *memoryCacheStore) remove(element *list.Element) {
+	item := s.order.Remove(element).(*memoryCacheItem)
+	delete(s.entries, item.key)
+	s.size -= item.size
+}
+
+func (s *memoryCacheStore) delete(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if element, ok := s.entries[key]; ok {
+		s.remove(element)
+	}
+}
+
+func (s *memoryCacheStore) purge(prefix string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for key, element := range s.entries {
+		if strings.HasPrefix(key, prefix) {
+			s.remove(element)
+		}
+	}
+}
+
+func (s *memoryCacheStore) claim(id string) bool {
+	return true
+}
+
+func (s *memoryCacheStore) close() {}
+
+// redisCacheStore - records shared by every proxy using the same redis
+type redisCacheStore struct {
+	client *redis.Client
+}
+
+func (s *redisCacheStore) get(key string) *cacheRecord {
+	encoded, err := s.client.Get(key).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			logger.Warn("could not read cache", "key", key, "err", err)
+		}
+		return nil
+	}
+	record := &cacheRecord{}
+	err = gob.NewDecoder(bytes.NewReader(encoded)).Decode(record)
+	if err != nil {
+		logger.Warn("could not decode cache record", "key", key, "err", err)
+		return nil
+	}
+	return record
+}
+
+func (s *redisCacheStore) set(key string, record *cacheRecord, ttl time.Duration) {
+	var encoded bytes.Buffer
+	err := gob.NewEncoder(&encoded).Encode(record)
+	if err == nil {
+		err = s.client.Set(key, encoded.Bytes(), ttl).Err()
+	}
+	if err != nil {
+		logger.Warn("could not write cache", "key", key, "err", err)
+	}
+}
+
+func (s *redisCacheStore) delete(key string) {
+	err := s.client.Del(key).Err()
+	if err != nil {
+		logger.Warn("could not delete from cache", "key", key, "err", err)
+	}
+}
+
+// purge scans for the keys under prefix in batches, rather than blocking
+// redis with KEYS
+func (s *redisCacheStore) purge(prefix string) {
+	match := redisGlobEscaper.Replace(prefix) + "*"
+	cursor := uint64(0)
+	for {
+		keys, next, err := s.client.Scan(cursor, match, 1000).Result()
+		if err == nil && len(keys) > 0 {
+			err = s.client.Del(keys...).Err()
+		}
+		if err != nil {
+			logger.Warn("could not purge cache", "prefix", prefix, "err", err)
+			return
+		}
+		if next == 0 {
+			return
+		}
+		cursor = next
+	}
+}
+
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+func (s *redisCacheStore) claim(id string) bool {
+	claimed, err := s.client.SetNX("byway.cache.purged."+id, 1, time.Hour).Result()
+	if err != nil {
+		logger.Warn("could not claim cache purge", "id", id, "err", err)
+		return false
+	}
+	return claimed
+}
+
+func (s *redisCacheStore) close() {
+	s.client.Close()
+}
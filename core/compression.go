@@ -0,0 +1,360 @@
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+const defaultCompressionMinSize = 1024
+
+var defaultCompressionEncodings = []string{"br", "zstd", "gzip"}
+
+var defaultCompressionContentTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// CompressionConfig - compression of responses for clients which accept it.
+// Config.Compression holds the defaults, and the fields a binding sets
+// override them. Encodings are preferred in order, from br, zstd and gzip.
+// Only ContentTypes, which may end in /*, of at least MinSize bytes (1024 by
+// default) are compressed. Decompress decodes upstream responses in an
+// encoding the client does not accept
+type CompressionConfig struct {
+	Enabled      *bool    `json:"enabled,omitempty" yaml:"enabled,omitempty"`
+	Encodings    []string `json:"encodings,omitempty" yaml:"encodings,omitempty"`
+	ContentTypes []string `json:"content_types,omitempty" yaml:"content_types,omitempty"`
+	MinSize      int64    `json:"min_size,omitempty" yaml:"min_size,omitempty"`
+	Decompress   *bool    `json:"decompress,omitempty" yaml:"decompress,omitempty"`
+}
+
+type compression struct {
+	enabled      bool
+	encodings    []string
+	contentTypes []string
+	minSize      int64
+	decompress   bool
+}
+
+// encoder - a compressor which can be flushed and reused
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+var encoderPools = map[string]*sync.Pool{
+	"gzip": {New: func() interface{} { return gzip.NewWriter(nil) }},
+	"br":   {New: func() interface{} { return brotli.NewWriterLevel(nil, 4) }},
+	"zstd": {New: func() interface{} {
+		encoder, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return encoder
+	}},
+}
+
+// mapCompressionConfig merges the compression of a binding over the defaults
+func mapCompressionConfig(defaults *CompressionConfig, override *CompressionConfig) (*compression, error) {
+	if defaults == nil && override == nil {
+		return nil, nil
+	}
+	merged := CompressionConfig{}
+	for _, cfg := range []*CompressionConfig{defaults, override} {
+		if cfg == nil {
+			continue
+		}
+		if cfg.Enabled != nil {
+			merged.Enabled = cfg.Enabled
+		}
+		if len(cfg.Encodings) > 0 {
+			merged.Encodings = cfg.Encodings
+		}
+		if len(cfg.ContentTypes) > 0 {
+			merged.ContentTypes = cfg.ContentTypes
+		}
+		if cfg.MinSize != 0 {
+			merged.MinSize = cfg.MinSize
+		}
+		if cfg.Decompress != nil {
+			merged.Decompress = cfg.Decompress
+		}
+	}
+
+	c := &compression{
+		enabled:      merged.Enabled == nil || *merged.Enabled,
+		encodings:    defaultCompressionEncodings,
+		contentTypes: defaultCompressionContentTypes,
+		minSize:      defaultCompressionMinSize,
+		decompress:   merged.Decompress != nil && *merged.Decompress,
+	}
+	if len(merged.Encodings) > 0 {
+		c.encodings = make([]string, len(merged.Encodings))
+		for i, encoding := range merged.Encodings {
+			encoding = strings.ToLower(encoding)
+			if encoderPools[encoding] == nil {
+				return nil, fmt.Errorf("unknown encoding %s", encoding)
+			}
+			c.encodings[i] = encoding
+		}
+	}
+	if len(merged.ContentTypes) > 0 {
+		c.contentTypes = merged.ContentTypes
+	}
+	if merged.MinSize < 0 {
+		return nil, fmt.Errorf("min_size must not be negative")
+	}
+	if merged.MinSize > 0 {
+		c.minSize = merged.MinSize
+	}
+	return c, nil
+}
+
+// acceptedEncodings parses Accept-Encoding into the q value of each coding
+func acceptedEncodings(header string) map[string]float64 {
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		name, value, _ := strings.Cut(strings.TrimSpace(params), "=")
+		if strings.TrimSpace(name) == "q" {
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err == nil {
+				q = parsed
+			}
+		}
+		accepted[coding] = q
+	}
+	return accepted
+}
+
+func acceptsEncoding(accepted map[string]float64, coding string) bool {
+	if q, ok := accepted[coding]; ok {
+		return q > 0
+	}
+	if q, ok := accepted["*"]; ok {
+		return q > 0
+	}
+	return false
+}
+
+// negotiate picks the encoding with the highest q value, preferring earlier
+// encodings on ties
+func (c *compression) negotiate(acceptEncoding string) string {
+	accepted := acceptedEncodings(acceptEncoding)
+	best, bestQ := "", 0.0
+	for _, encoding := range c.encodings {
+		q, ok := accepted[encoding]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+func (c *compression) compressible(resp *http.Response) bool {
+	if resp.Request.Method == http.MethodHead || resp.Body == nil || resp.Body == http.NoBody {
+		return false
+	}
+	if resp.StatusCode < http.StatusOK || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return false
+	}
+	// a compressed byte range is not a range of any representation
+	if resp.StatusCode == http.StatusPartialContent || resp.Header.Get("Content-Range") != "" {
+		return false
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return false
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength < c.minSize {
+		return false
+	}
+	if strings.Contains(strings.ToLower(resp.Header.Get("Cache-Control")), "no-transform") {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, contentType := range c.contentTypes {
+		if strings.HasSuffix(contentType, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(contentType, "*")) {
+			return true
+		}
+		if strings.EqualFold(mediaType, contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+// decode decompresses resp when the client can not accept its encoding
+func (c *compression) decode(resp *http.Response, acceptEncoding string) error {
+	if c == nil || !c.decompress || resp.Request.Method == http.MethodHead || resp.Body == nil || resp.Body == http.NoBody {
+		return nil
+	}
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding == "" || encoding == "identity" || acceptsEncoding(acceptedEncodings(acceptEncoding), encoding) {
+		return nil
+	}
+
+	var decoded io.ReadCloser
+	switch encoding {
+	case "gzip":
+		reader, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return err
+		}
+		decoded = &decodedBody{Reader: reader, source: resp.Body}
+	case "br":
+		decoded = &decodedBody{Reader: brotli.NewReader(resp.Body), source: resp.Body}
+	case "zstd":
+		reader, err := zstd.NewReader(resp.Body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		decoded = &decodedBody{Reader: reader, source: resp.Body, release: reader.Close}
+	default:
+		return nil
+	}
+
+	resp.Body = decoded
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	addVary(resp.Header, "Accept-Encoding")
+	return nil
+}
+
+// encode compresses resp in the encoding the client prefers. Streamed
+// responses, server-sent events or those of a binding with a flush interval,
+// are flushed after every read of the upstream
+func (c *compression) encode(resp *http.Response, acceptEncoding string, streamed bool) {
+	if c == nil || !c.enabled || !c.compressible(resp) {
+		return
+	}
+	addVary(resp.Header, "Accept-Encoding")
+	encoding := c.negotiate(acceptEncoding)
+	if encoding == "" {
+		return
+	}
+
+	pool := encoderPools[encoding]
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	body := &compressedBody{
+		source: resp.Body,
+		pool:   pool,
+		buffer: make([]byte, 32*1024),
+		flush:  streamed || mediaType == "text/event-stream",
+	}
+	body.encoder = pool.Get().(encoder)
+	body.encoder.Reset(&body.output)
+
+	resp.Body = body
+	resp.Header.Set("Content-Encoding", encoding)
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("Accept-Ranges")
+	resp.ContentLength = -1
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+}
+
+// compressedBody - compresses source as it is read. With flush set it
+// flushes after every read of source so streamed responses are not held
+// back, otherwise the encoder emits blocks as they fill
+type compressedBody struct {
+	source  io.ReadCloser
+	encoder encoder
+	pool    *sync.Pool
+	output  bytes.Buffer
+	buffer  []byte
+	flush   bool
+	err     error
+}
+
+func (b *compressedBody) Read(p []byte) (int, error) {
+	for b.output.Len() == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+		n, err := b.source.Read(b.buffer)
+		if n > 0 {
+			_, b.err = b.encoder.Write(b.buffer[:n])
+		}
+		if b.err != nil {
+			b.release()
+		} else if err == io.EOF {
+			b.err = b.encoder.Close()
+			b.release()
+			if b.err == nil {
+				b.err = io.EOF
+			}
+		} else if err != nil {
+			b.err = err
+		} else if n > 0 && b.flush {
+			b.err = b.encoder.Flush()
+		}
+	}
+	return b.output.Read(p)
+}
+
+func (b *compressedBody) release() {
+	if b.encoder != nil {
+		b.encoder.Reset(nil)
+		b.pool.Put(b.encoder)
+		b.encoder = nil
+	}
+}
+
+func (b *compressedBody) Close() error {
+	if b.err == nil {
+		b.err = io.ErrClosedPipe
+	}
+	b.release()
+	return b.source.Close()
+}
+
+// addVary adds name to the Vary header once
+func addVary(header http.Header, name string) {
+	for _, value := range header.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			if field == "*" || strings.EqualFold(field, name) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", name)
+}
+
+type decodedBody struct {
+	io.Reader
+	source  io.ReadCloser
+	release func()
+}
+
+func (b *decodedBody) Close() error {
+	if b.release != nil {
+		b.release()
+	}
+	return b.source.Close()
+}
@@ -0,0 +1,203 @@
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func mustMapCompressionConfig(t *testing.T, cfg *CompressionConfig) *compression {
+	t.Helper()
+	c, err := mapCompressionConfig(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func newCompressionTestResponse(header http.Header, body string) *http.Response {
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        header,
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(strings.NewReader(body)),
+		Request:       httptest.NewRequest("GET", "/", nil),
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	c := mustMapCompressionConfig(t, &CompressionConfig{})
+	for acceptEncoding, expected := range map[string]string{
+		"":                        "",
+		"identity":                "",
+		"gzip":                    "gzip",
+		"GZIP":                    "gzip",
+		"gzip, br":                "br",
+		"gzip, zstd":              "zstd",
+		"gzip;q=1, br;q=0.5":      "gzip",
+		"gzip ; q=0.8, zstd;q=.9": "zstd",
+		"gzip;q=0":                "",
+		"*":                       "br",
+		"*;q=0.5, gzip":           "gzip",
+		"br;q=0, *":               "zstd",
+		"deflate, compress":       "",
+	} {
+		if encoding := c.negotiate(acceptEncoding); encoding != expected {
+			t.Errorf("%q negotiated %q, expected %q", acceptEncoding, encoding, expected)
+		}
+	}
+
+	gzipFirst := mustMapCompressionConfig(t, &CompressionConfig{Encodings: []string{"GZIP", "br"}})
+	if encoding := gzipFirst.negotiate("br, gzip, zstd"); encoding != "gzip" {
+		t.Errorf("configured order negotiated %q, expected gzip", encoding)
+	}
+}
+
+func TestCompressionConfigErrors(t *testing.T) {
+	for _, cfg := range []CompressionConfig{
+		{Encodings: []string{"deflate"}},
+		{MinSize: -1},
+	} {
+		if _, err := mapCompressionConfig(nil, &cfg); err == nil {
+			t.Errorf("%+v: expected an error", cfg)
+		}
+	}
+
+	disabled := false
+	c, err := mapCompressionConfig(&CompressionConfig{MinSize: 10, Enabled: &disabled}, &CompressionConfig{Encodings: []string{"gzip"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.enabled || c.minSize != 10 || strings.Join(c.encodings, ",") != "gzip" {
+		t.Errorf("merged to %+v", c)
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	c := mustMapCompressionConfig(t, &CompressionConfig{MinSize: 10})
+	body := strings.Repeat("a", 10)
+	for _, test := range []struct {
+		name     string
+		modify   func(resp *http.Response)
+		expected bool
+	}{
+		{"html", func(resp *http.Response) {}, true},
+		{"wildcard content type", func(resp *http.Response) { resp.Header.Set("Content-Type", "text/css") }, true},
+		{"json", func(resp *http.Response) { resp.Header.Set("Content-Type", "application/json; charset=utf-8") }, true},
+		{"image", func(resp *http.Response) { resp.Header.Set("Content-Type", "image/png") }, false},
+		{"no content type", func(resp *http.Response) { resp.Header.Del("Content-Type") }, false},
+		{"unknown length", func(resp *http.Response) { resp.ContentLength = -1 }, true},
+		{"smaller than min_size", func(resp *http.Response) { resp.ContentLength = 9 }, false},
+		{"encoded", func(resp *http.Response) { resp.Header.Set("Content-Encoding", "gzip") }, false},
+		{"no-transform", func(resp *http.Response) { resp.Header.Set("Cache-Control", "public, No-Transform") }, false},
+		{"partial content", func(resp *http.Response) { resp.StatusCode = http.StatusPartialContent }, false},
+		{"content range", func(resp *http.Response) { resp.Header.Set("Content-Range", "bytes 0-9/100") }, false},
+		{"not modified", func(resp *http.Response) { resp.StatusCode = http.StatusNotModified }, false},
+		{"HEAD", func(resp *http.Response) { resp.Request.Method = http.MethodHead }, false},
+	} {
+		resp := newCompressionTestResponse(http.Header{"Content-Type": {"text/html"}}, body)
+		test.modify(resp)
+		if compressible := c.compressible(resp); compressible != test.expected {
+			t.Errorf("%s: compressible was %v", test.name, compressible)
+		}
+	}
+}
+
+func TestEncodeAndDecode(t *testing.T) {
+	enabled := true
+	c := mustMapCompressionConfig(t, &CompressionConfig{Decompress: &enabled})
+	body := strings.Repeat("byway compresses text. ", 200)
+	readers := map[string]func(io.Reader) (io.Reader, error){
+		"gzip": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"br":   func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+		"zstd": func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) },
+	}
+
+	for encoding, newReader := range readers {
+		resp := newCompressionTestResponse(http.Header{"Content-Type": {"text/plain"}, "Etag": {`"v1"`}}, body)
+		c.encode(resp, encoding, false)
+		if resp.Header.Get("Content-Encoding") != encoding || resp.Header.Get("Vary") != "Accept-Encoding" || resp.Header.Get("ETag") != `W/"v1"` {
+			t.Errorf("%s: encoded with headers %v", encoding, resp.Header)
+		}
+		encoded, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("%s: %s", encoding, err)
+		}
+		if len(encoded) >= len(body) {
+			t.Errorf("%s: encoded %d bytes into %d", encoding, len(body), len(encoded))
+		}
+
+		reader, err := newReader(bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatalf("%s: %s", encoding, err)
+		}
+		if decoded, err := io.ReadAll(reader); err != nil || string(decoded) != body {
+			t.Errorf("%s: did not round trip, %v", encoding, err)
+		}
+
+		// a client which only accepts another encoding gets the body decoded
+		resp = newCompressionTestResponse(http.Header{"Content-Encoding": {encoding}}, string(encoded))
+		if err := c.decode(resp, "identity"); err != nil {
+			t.Fatalf("%s: %s", encoding, err)
+		}
+		decoded, err := io.ReadAll(resp.Body)
+		if err != nil || string(decoded) != body || resp.Header.Get("Content-Encoding") != "" {
+			t.Errorf("%s: decode read %d bytes with Content-Encoding %q, %v", encoding, len(decoded), resp.Header.Get("Content-Encoding"), err)
+		}
+
+		resp = newCompressionTestResponse(http.Header{"Content-Encoding": {encoding}}, string(encoded))
+		if c.decode(resp, encoding+";q=0.5"); resp.Header.Get("Content-Encoding") != encoding {
+			t.Errorf("%s: decoded for a client which accepts it", encoding)
+		}
+	}
+}
+
+// countingReader - counts the bytes read from it
+type countingReader struct {
+	io.Reader
+	read int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.read += n
+	return n, err
+}
+
+func TestCompressedBodyFlushesOnlyWhenStreamed(t *testing.T) {
+	c := mustMapCompressionConfig(t, &CompressionConfig{Encodings: []string{"gzip"}})
+	body := strings.Repeat("data: event\n\n", 1000)
+
+	for _, test := range []struct {
+		name        string
+		contentType string
+		streamed    bool
+		flushes     bool
+	}{
+		{"buffered", "text/plain", false, false},
+		{"flush interval", "text/plain", true, true},
+		{"server-sent events", "text/event-stream", false, true},
+	} {
+		source := &countingReader{Reader: iotest.OneByteReader(strings.NewReader(body))}
+		resp := newCompressionTestResponse(http.Header{"Content-Type": {test.contentType}}, body)
+		resp.Body = io.NopCloser(source)
+		c.encode(resp, "gzip", test.streamed)
+
+		// past the gzip header, compressed bytes of a flushed body follow
+		// the first reads of it, otherwise they wait for the whole body
+		if _, err := io.ReadFull(resp.Body, make([]byte, 20)); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if flushed := source.read < len(body); flushed != test.flushes {
+			t.Errorf("%s: first output after reading %d of %d bytes", test.name, source.read, len(body))
+		}
+	}
+}
@@ -1,31 +1,91 @@
 package core
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"regexp"
 	"sort"
 	"strings"
+	"sync/atomic"
 
 	"github.com/hashicorp/go-version"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// EndpointConfig  config of an endpoint
+// EndpointConfig  config of an endpoint. Rewrite is a RewriteConfigString
+// applied to the path of requests routed to the endpoint. Headers are set on
+// upstream requests, as if listed in RequestHeaders.Set. Cache stores
+// responses in the shared cache of Config.Cache
 type EndpointConfig struct {
-	Host    string            `json:"host"`
-	Scheme  string            `json:"scheme"`
-	Rewrite string            `json:"rewrite"`
-	Headers map[string]string `json:"headers"`
+	Host             string                 `json:"host"`
+	Scheme           string                 `json:"scheme"`
+	Rewrite          string                 `json:"rewrite"`
+	Headers          map[string]string      `json:"headers"`
+	RequestHeaders   *HeaderPolicy          `json:"request_headers,omitempty" yaml:"request_headers,omitempty"`
+	ResponseHeaders  *HeaderPolicy          `json:"response_headers,omitempty" yaml:"response_headers,omitempty"`
+	ResponseRewrite  *ResponseRewriteConfig `json:"response_rewrite,omitempty" yaml:"response_rewrite,omitempty"`
+	Body             *BodyConfig            `json:"body,omitempty" yaml:"body,omitempty"`
+	Compression      *CompressionConfig     `json:"compression,omitempty" yaml:"compression,omitempty"`
+	Cache            bool                   `json:"cache,omitempty" yaml:"cache,omitempty"`
+	ProxyProtocol    string                 `json:"proxy_protocol,omitempty" yaml:"proxy_protocol,omitempty"`
+	ForwardedHeaders string                 `json:"forwarded_headers,omitempty" yaml:"forwarded_headers,omitempty"`
+}
+
+// ListenerConfig  config of a listener and the routing domain it serves.
+// Address is a tcp address or unix:<path>, protocol is http or https and
+// routing is host or path
+type ListenerConfig struct {
+	Address  string      `json:"address" yaml:"address"`
+	Protocol string      `json:"protocol" yaml:"protocol"`
+	CertFile string      `json:"cert_file,omitempty" yaml:"cert_file,omitempty"`
+	KeyFile  string      `json:"key_file,omitempty" yaml:"key_file,omitempty"`
+	Domains  []string    `json:"domains" yaml:"domains"`
+	Topology TopologyKey `json:"topology" yaml:"topology"`
+	Grammars []string    `json:"grammars,omitempty" yaml:"grammars,omitempty"`
+	Routing  string      `json:"routing,omitempty" yaml:"routing,omitempty"`
+}
+
+// ProxyProtocolConfig  config of PROXY protocol on the byway listeners
+type ProxyProtocolConfig struct {
+	Trusted []string `json:"trusted" yaml:"trusted"`
+}
+
+// DNSConfig  config of the embedded dns server
+type DNSConfig struct {
+	Listen    string   `json:"listen" yaml:"listen"`
+	Domains   []string `json:"domains" yaml:"domains"`
+	Addresses []string `json:"addresses" yaml:"addresses"`
+	Upstream  string   `json:"upstream" yaml:"upstream"`
+	TTL       uint32   `json:"ttl" yaml:"ttl"`
 }
 
 // Config - Raw byway configuration
 type Config struct {
-	Rewrites   []RewriteConfigString                            `json:"rewrites" yaml:"rewrites"`
-	Mapping    map[ServiceName]map[VersionString]EndpointConfig `json:"services" yaml:"services"`
-	Topologies map[TopologyKey]map[ServiceName]VersionString    `json:"topologies" yaml:"topologies"`
+	Rewrites      []RewriteConfigString                            `json:"rewrites" yaml:"rewrites"`
+	RewriteRules  []RewriteRuleConfig                              `json:"rewrite_rules,omitempty" yaml:"rewrite_rules,omitempty"`
+	Redirects     []RedirectRuleConfig                             `json:"redirects,omitempty" yaml:"redirects,omitempty"`
+	Mapping       map[ServiceName]map[VersionString]EndpointConfig `json:"services" yaml:"services"`
+	Topologies    map[TopologyKey]map[ServiceName]VersionString    `json:"topologies" yaml:"topologies"`
+	DNS           *DNSConfig                                       `json:"dns,omitempty" yaml:"dns,omitempty"`
+	ProxyProtocol *ProxyProtocolConfig                             `json:"proxy_protocol,omitempty" yaml:"proxy_protocol,omitempty"`
+	Listeners     map[string]ListenerConfig                        `json:"listeners,omitempty" yaml:"listeners,omitempty"`
+	Grammars      []string                                         `json:"grammars,omitempty" yaml:"grammars,omitempty"`
+	RouteCache    *RouteCacheConfig                                `json:"route_cache,omitempty" yaml:"route_cache,omitempty"`
+	Logging       *LoggingConfig                                   `json:"logging,omitempty" yaml:"logging,omitempty"`
+	AccessLog     *AccessLogConfig                                 `json:"access_log,omitempty" yaml:"access_log,omitempty"`
+	Admin         *AdminConfig                                     `json:"admin,omitempty" yaml:"admin,omitempty"`
+	Tracing       *TracingConfig                                   `json:"tracing,omitempty" yaml:"tracing,omitempty"`
+	RequestID     *RequestIDConfig                                 `json:"request_id,omitempty" yaml:"request_id,omitempty"`
+	Forwarded     *ForwardedConfig                                 `json:"forwarded,omitempty" yaml:"forwarded,omitempty"`
+	Secrets       map[string]string                                `json:"secrets,omitempty" yaml:"secrets,omitempty"`
+	Compression   *CompressionConfig                               `json:"compression,omitempty" yaml:"compression,omitempty"`
+	Cache         *CacheConfig                                     `json:"cache,omitempty" yaml:"cache,omitempty"`
+	RateLimit     *RateLimitConfig                                 `json:"rate_limit,omitempty" yaml:"rate_limit,omitempty"`
 }
 
 // Headers - a list of headers to set
@@ -35,10 +95,19 @@ type Headers map[string]string
 type stringRewrite func(string) string
 
 type binding struct {
-	host          string
-	scheme        string
-	pathRewriteFn stringRewrite
-	headers       Headers
+	service         ServiceName
+	version         VersionString
+	host            string
+	scheme          string
+	pathRewriteFn   stringRewrite
+	requestHeaders  *headerPolicy
+	responseHeaders *headerPolicy
+	responseRewrite *responseRewrite
+	body            *bodyPolicy
+	compression     *compression
+	proxyProtocol   byte
+	forwarded       byte
+	cache           bool
 }
 
 // TopologyKey - a key represenenting a specific topology
@@ -50,13 +119,34 @@ type VersionString string
 // ServiceName - A name of a service
 type ServiceName string
 
-type serviceMappingTable map[ServiceName]map[VersionString]binding
+// versionTable - the bindings of a service, with parsed versions sorted ascending
+type versionTable struct {
+	bindings map[VersionString]binding
+	versions []*version.Version
+	sorted   []*binding
+}
+
+type serviceMappingTable map[ServiceName]*versionTable
 type topologyTable map[TopologyKey]map[ServiceName]VersionString
 
+type listener struct {
+	suffixes []string
+	topology TopologyKey
+	grammars []*grammar
+}
+
 type config struct {
-	rewrites   []stringRewrite
-	mapping    serviceMappingTable
-	topologies topologyTable
+	rewrites         *rewriteEngine
+	redirects        []redirectRule
+	mapping          serviceMappingTable
+	topologies       topologyTable
+	trustedProxies   []*net.IPNet
+	forwardedTrusted []*net.IPNet
+	listeners        map[string]listener
+	grammars         []*grammar
+	requestIDHeader  string
+	rateLimits       []*rateLimitRule
+	generation       uint64
 }
 
 // NewConfig creates a new config object
@@ -77,90 +167,287 @@ func IdentityRewrite(input string) string {
 // bob/bazzer -> foo/bazzer
 type RewriteConfigString string
 
-func newRegexReplaceRewriteFromRewriteConfigString(rewrite RewriteConfigString) stringRewrite {
+func parseRewriteConfigString(rewrite RewriteConfigString) (string, string, error) {
 	str := string(rewrite)
 	p := strings.Split(str, ";")
 
 	if len(p) != 2 {
-		log.Fatalf("byway: NewRegexReplaceRewriteFromRewriteConfigString: invalid input: %s", str)
+		return "", "", fmt.Errorf("invalid rewrite, expected <regex>;<replacement>: %s", str)
 	}
 
-	return newRegexReplaceRewrite(p[0], p[1])
+	return p[0], p[1], nil
 }
 
-func newRegexReplaceRewrite(pattern string, replace string) stringRewrite {
-	re := regexp.MustCompile(pattern)
+func newRegexReplaceRewriteFromRewriteConfigString(rewrite RewriteConfigString) (stringRewrite, error) {
+	pattern, replace, err := parseRewriteConfigString(rewrite)
+	if err != nil {
+		return nil, err
+	}
 
-	fn := func(input string) string {
-		result := re.ReplaceAllString(input, replace)
-		if result != input {
-			log.Printf("byway: Rewrite %s -> %s", input, result)
-		}
-		return result
+	return newRegexReplaceRewrite(pattern, replace)
+}
+
+func newRegexReplaceRewrite(pattern string, replace string) (stringRewrite, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return regexReplaceRewrite(re, replace), nil
+}
+
+func regexReplaceRewrite(re *regexp.Regexp, replace string) stringRewrite {
+	return func(input string) string {
+		return re.ReplaceAllString(input, replace)
 	}
-	return fn
 }
 
-func rewriteURL(config *config, input *url.URL) *url.URL {
+// maxRewriteIterations - the number of rewrites applied to a single url before giving up
+const maxRewriteIterations = 32
+
+// maxRewriteLength - the longest url a rewrite may produce
+const maxRewriteLength = 8192
+
+func rewriteURL(config *config, req *http.Request, topology TopologyKey) (*url.URL, error) {
+	if config.rewrites == nil {
+		return req.URL, nil
+	}
+
 	matched := make(map[string]bool)
-	accumulator := input.String()
-	for {
-		rewriteResult := accumulator
-		for _, rewrite := range config.rewrites {
-			rewriteResult = rewrite(accumulator)
-			if rewriteResult != accumulator {
-				break
-			}
-		}
+	input := req.URL.String()
+	accumulator := input
+	for iteration := 0; ; iteration++ {
+		rewriteResult := config.rewrites.apply(accumulator, req, topology)
 		if rewriteResult == accumulator {
+			if rewriteResult != input {
+				logger.DebugContext(req.Context(), "rewrite", "from", input, "to", rewriteResult)
+			}
+			if rewriteResult == input {
+				return req.URL, nil
+			}
 			result, err := url.Parse(rewriteResult)
 			if err != nil {
-				log.Fatal(err)
+				return nil, &routeError{http.StatusInternalServerError, fmt.Sprintf("rewrite produced an invalid url: %s", err)}
 			}
-			return result
+			return result, nil
 		}
 		if matched[rewriteResult] {
-			log.Fatal("Recursive rewrite detected")
-
+			return nil, &routeError{http.StatusLoopDetected, fmt.Sprintf("recursive rewrite detected: %s", rewriteResult)}
+		}
+		if len(rewriteResult) > maxRewriteLength {
+			return nil, &routeError{http.StatusLoopDetected, fmt.Sprintf("rewrite produced a url longer than %d", maxRewriteLength)}
+		}
+		if iteration >= maxRewriteIterations {
+			return nil, &routeError{http.StatusLoopDetected, fmt.Sprintf("rewrite limit of %d exceeded: %s", maxRewriteIterations, rewriteResult)}
 		}
 		matched[rewriteResult] = true
 
 		accumulator = rewriteResult
 	}
 }
-func mapEndpointConfig(endpointConfig EndpointConfig) binding {
+
+func mapEndpointConfig(endpointConfig EndpointConfig, secrets *secretStore) (binding, error) {
+	pathRewriteFn := IdentityRewrite
+	if endpointConfig.Rewrite != "" {
+		rewrite, err := newRegexReplaceRewriteFromRewriteConfigString(RewriteConfigString(endpointConfig.Rewrite))
+		if err != nil {
+			return binding{}, fmt.Errorf("rewrite: %s", err)
+		}
+		pathRewriteFn = rewrite
+	}
+
+	proxyProtocol, err := proxyProtocolVersion(endpointConfig.ProxyProtocol)
+	if err != nil {
+		return binding{}, err
+	}
+
+	forwarded, err := forwardedStyle(endpointConfig.ForwardedHeaders)
+	if err != nil {
+		return binding{}, err
+	}
+
+	requestHeaders, err := mapHeaderPolicy(endpointConfig.RequestHeaders, endpointConfig.Headers, secrets)
+	if err != nil {
+		return binding{}, fmt.Errorf("request_headers.%s", err)
+	}
+	responseHeaders, err := mapHeaderPolicy(endpointConfig.ResponseHeaders, nil, secrets)
+	if err != nil {
+		return binding{}, fmt.Errorf("response_headers.%s", err)
+	}
+	responseRewrite, err := mapResponseRewriteConfig(endpointConfig.ResponseRewrite, secrets)
+	if err != nil {
+		return binding{}, fmt.Errorf("response_rewrite.%s", err)
+	}
+	body, err := mapBodyConfig(endpointConfig.Body)
+	if err != nil {
+		return binding{}, fmt.Errorf("body.%s", err)
+	}
+
 	return binding{
-		host:          endpointConfig.Host,
-		scheme:        endpointConfig.Scheme,
-		headers:       endpointConfig.Headers,
-		pathRewriteFn: IdentityRewrite}
+		host:            endpointConfig.Host,
+		scheme:          endpointConfig.Scheme,
+		requestHeaders:  requestHeaders,
+		responseHeaders: responseHeaders,
+		responseRewrite: responseRewrite,
+		body:            body,
+		proxyProtocol:   proxyProtocol,
+		forwarded:       forwarded,
+		cache:           endpointConfig.Cache,
+		pathRewriteFn:   pathRewriteFn}, nil
 }
 
-func mapConfig(rawConfig *Config) *config {
+// ValidateConfig reports the first problem which would cause the proxy to reject rawConfig
+func ValidateConfig(rawConfig *Config) error {
+	_, err := mapConfig(rawConfig)
+	return err
+}
+
+func mapConfig(rawConfig *Config) (*config, error) {
 	newConfig := config{
-		mapping:    make(map[ServiceName]map[VersionString]binding),
+		mapping:    make(serviceMappingTable),
 		topologies: rawConfig.Topologies,
+		listeners:  make(map[string]listener),
 	}
 
-	for _, r := range rawConfig.Rewrites {
-		rewrite := newRegexReplaceRewriteFromRewriteConfigString(r)
-		newConfig.rewrites = append(newConfig.rewrites, rewrite)
+	rewrites := make([]rewriteRule, 0)
+	for i, r := range rawConfig.Rewrites {
+		rule, err := mapRewriteConfigString(r)
+		if err != nil {
+			return nil, fmt.Errorf("rewrites[%d]: %s", i, err)
+		}
+		rewrites = append(rewrites, rule)
 	}
 
-	for k, v := range rawConfig.Mapping {
+	for i, r := range rawConfig.RewriteRules {
+		rule, err := mapRewriteRuleConfig(r)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite_rules[%d]: %s", i, err)
+		}
+		rewrites = append(rewrites, rule)
+	}
+	newConfig.rewrites = newRewriteEngine(rewrites)
 
-		version := make(map[VersionString]binding)
-		newConfig.mapping[ServiceName(k)] = version
-		for k, v := range v {
-			version[VersionString(k)] = mapEndpointConfig(v)
+	for i, r := range rawConfig.Redirects {
+		rule, err := mapRedirectRuleConfig(r)
+		if err != nil {
+			return nil, fmt.Errorf("redirects[%d]: %s", i, err)
 		}
+		newConfig.redirects = append(newConfig.redirects, rule)
+	}
+
+	_, err := mapCompressionConfig(rawConfig.Compression, nil)
+	if err != nil {
+		return nil, fmt.Errorf("compression: %s", err)
+	}
+
+	secrets := &secretStore{encrypted: rawConfig.Secrets}
+	for k, v := range rawConfig.Mapping {
+		bindings := make(map[VersionString]binding)
+		for vk, v := range v {
+			binding, err := mapEndpointConfig(v, secrets)
+			if err != nil {
+				return nil, fmt.Errorf("services.%s.%s: %s", k, vk, err)
+			}
+			binding.compression, err = mapCompressionConfig(rawConfig.Compression, v.Compression)
+			if err != nil {
+				return nil, fmt.Errorf("services.%s.%s: compression: %s", k, vk, err)
+			}
+			binding.service = ServiceName(k)
+			binding.version = VersionString(vk)
+			bindings[VersionString(vk)] = binding
+		}
+		newConfig.mapping[ServiceName(k)] = newVersionTable(bindings)
 	}
 
 	if newConfig.topologies == nil {
 		newConfig.topologies = make(map[TopologyKey]map[ServiceName]VersionString)
 	}
 
-	return &newConfig
+	if rawConfig.ProxyProtocol != nil {
+		trustedProxies, err := parseCIDRs(rawConfig.ProxyProtocol.Trusted)
+		if err != nil {
+			return nil, fmt.Errorf("proxy_protocol: %s", err)
+		}
+		newConfig.trustedProxies = trustedProxies
+	}
+
+	if rawConfig.Forwarded != nil {
+		forwardedTrusted, err := parseCIDRs(rawConfig.Forwarded.Trusted)
+		if err != nil {
+			return nil, fmt.Errorf("forwarded: %s", err)
+		}
+		newConfig.forwardedTrusted = forwardedTrusted
+	}
+
+	grammars, err := compileGrammars(rawConfig.Grammars)
+	if err != nil {
+		return nil, fmt.Errorf("grammars: %s", err)
+	}
+	newConfig.grammars = grammars
+	newConfig.requestIDHeader = mapRequestIDConfig(rawConfig.RequestID)
+
+	newConfig.rateLimits, err = mapRateLimitConfig(rawConfig.RateLimit)
+	if err != nil {
+		return nil, fmt.Errorf("rate_limit: %s", err)
+	}
+
+	for name, listenerConfig := range rawConfig.Listeners {
+		listener, err := mapListenerConfig(listenerConfig, newConfig.grammars)
+		if err != nil {
+			return nil, fmt.Errorf("listeners.%s: %s", name, err)
+		}
+		newConfig.listeners[name] = listener
+	}
+
+	if rawConfig.Logging != nil {
+		err := validateLoggingConfig(rawConfig.Logging)
+		if err != nil {
+			return nil, fmt.Errorf("logging: %s", err)
+		}
+	}
+
+	if rawConfig.AccessLog != nil {
+		err := validateAccessLogConfig(*rawConfig.AccessLog)
+		if err != nil {
+			return nil, fmt.Errorf("access_log: %s", err)
+		}
+	}
+
+	if rawConfig.Tracing != nil {
+		err := validateTracingConfig(*rawConfig.Tracing)
+		if err != nil {
+			return nil, fmt.Errorf("tracing: %s", err)
+		}
+	}
+
+	if rawConfig.Cache != nil {
+		err := validateCacheConfig(*rawConfig.Cache)
+		if err != nil {
+			return nil, fmt.Errorf("cache: %s", err)
+		}
+	}
+
+	return &newConfig, nil
+}
+
+func newVersionTable(bindings map[VersionString]binding) *versionTable {
+	table := &versionTable{bindings: bindings}
+
+	for versionStr := range bindings {
+		v, err := version.NewVersion(string(versionStr))
+		if err != nil {
+			logger.Warn("could not parse version", "version", versionStr, "err", err)
+		} else {
+			table.versions = append(table.versions, v)
+		}
+	}
+	sort.Sort(version.Collection(table.versions))
+
+	for _, v := range table.versions {
+		binding := bindings[VersionString(v.Original())]
+		table.sorted = append(table.sorted, &binding)
+	}
+
+	return table
 }
 
 func versionify(versionStr string) *version.Version {
@@ -172,24 +459,40 @@ func versionify(versionStr string) *version.Version {
 	return v
 }
 
-func extractRoutingParameters(req *http.Request) (TopologyKey, *version.Version, *version.Version, ServiceName) {
-	log.Print("byway: -- extractRoutingParameters --")
-	log.Printf("byway: URL: %s ", req.URL)
+func extractRoutingParameters(req *http.Request, listener listener) (TopologyKey, *version.Version, *version.Version, ServiceName) {
+	ctx := req.Context()
+	logger.DebugContext(ctx, "extracting routing parameters", "url", req.URL)
 	var minVersion *version.Version
 	var maxVersion *version.Version
 	var serviceName string
 
-	hostComponents := strings.Split(req.URL.Host, ".")
-	log.Printf("byway: host components:  %s ", hostComponents)
+	host := stripHostSuffix(req.URL.Host, listener.suffixes)
+	for _, grammar := range listener.grammars {
+		values, path, ok := grammar.match(host, req.URL.Path)
+		if ok {
+			logger.DebugContext(ctx, "matched grammar", "grammar", grammar.template)
+			if path != req.URL.Path {
+				req.URL.Path = path
+				req.URL.RawPath = ""
+			}
+			return extractGrammarParameters(req, listener, values)
+		}
+	}
+
+	hostComponents := strings.Split(host, ".")
+	logger.DebugContext(ctx, "host components", "components", hostComponents)
 
 	i := 0
 
 	topologyKey := TopologyKey(req.Header.Get("x-byway-topology"))
+	if topologyKey == "" {
+		topologyKey = listener.topology
+	}
 	if strings.HasPrefix(hostComponents[i], "t-") {
 
 		topologyKey = TopologyKey(hostComponents[i])
 		topologyKey = topologyKey[2:len(topologyKey)]
-		log.Printf("byway: Identified topology from host: %s", topologyKey)
+		logger.DebugContext(ctx, "identified topology", "source", "host", "topology", topologyKey)
 		i++
 	}
 
@@ -197,34 +500,70 @@ func extractRoutingParameters(req *http.Request) (TopologyKey, *version.Version,
 	if minVersion == nil {
 		minVersion = versionify(hostComponents[i])
 		if minVersion != nil {
-			log.Printf("byway: Identified min version from host: %s", minVersion)
+			logger.DebugContext(ctx, "identified min version", "source", "host", "version", minVersion)
 			i++
 		} else {
-			log.Printf("byway: Could not identify min version")
+			logger.DebugContext(ctx, "could not identify min version")
 		}
 	} else {
-		log.Printf("byway: Found min version from header: %s", minVersion)
+		logger.DebugContext(ctx, "identified min version", "source", "header", "version", minVersion)
 	}
 
 	maxVersion = versionify(req.Header.Get("x-byway-max"))
 	if maxVersion == nil {
 		maxVersion = versionify(hostComponents[i])
 		if maxVersion != nil {
-			log.Printf("byway: Identified max version from host: %s", maxVersion)
+			logger.DebugContext(ctx, "identified max version", "source", "host", "version", maxVersion)
 			i++
 		} else {
-			log.Printf("byway: Could not identify max version")
+			logger.DebugContext(ctx, "could not identify max version")
 		}
 	} else {
-		log.Printf("byway: Found max version from header: %s", maxVersion)
+		logger.DebugContext(ctx, "identified max version", "source", "header", "version", maxVersion)
 	}
 
 	serviceName = req.Header.Get("x-byway-service")
 	if serviceName == "" {
 		serviceName = hostComponents[i]
-		log.Printf("byway: Identified service from host: %s", serviceName)
+		logger.DebugContext(ctx, "identified service", "source", "host", "service", serviceName)
 	} else {
-		log.Printf("byway: Identified service from header: %s", serviceName)
+		logger.DebugContext(ctx, "identified service", "source", "header", "service", serviceName)
+	}
+
+	return topologyKey, minVersion, maxVersion, ServiceName(serviceName)
+}
+
+func extractGrammarParameters(req *http.Request, listener listener, values map[string]string) (TopologyKey, *version.Version, *version.Version, ServiceName) {
+	topologyKey := TopologyKey(req.Header.Get("x-byway-topology"))
+	if topologyKey == "" {
+		topologyKey = listener.topology
+	}
+	if values["topology"] != "" {
+		topologyKey = TopologyKey(values["topology"])
+		logger.DebugContext(req.Context(), "identified topology", "source", "grammar", "topology", topologyKey)
+	}
+
+	if values["version"] != "" {
+		values["min"] = values["version"]
+		values["max"] = values["version"]
+	}
+
+	minVersion := versionify(req.Header.Get("x-byway-min"))
+	if minVersion == nil {
+		minVersion = versionify(values["min"])
+		logger.DebugContext(req.Context(), "identified min version", "source", "grammar", "version", minVersion)
+	}
+
+	maxVersion := versionify(req.Header.Get("x-byway-max"))
+	if maxVersion == nil {
+		maxVersion = versionify(values["max"])
+		logger.DebugContext(req.Context(), "identified max version", "source", "grammar", "version", maxVersion)
+	}
+
+	serviceName := req.Header.Get("x-byway-service")
+	if serviceName == "" {
+		serviceName = values["service"]
+		logger.DebugContext(req.Context(), "identified service", "source", "grammar", "service", serviceName)
 	}
 
 	return topologyKey, minVersion, maxVersion, ServiceName(serviceName)
@@ -246,121 +585,263 @@ func bulidContraint(minVersion *version.Version, maxVersion *version.Version) ve
 	return constraint
 }
 
-func resolveBinding(config *config, topoloyKey TopologyKey, minVersion *version.Version, maxVersion *version.Version, serviceName ServiceName) *binding {
-
-	log.Printf("byway: -- Locating version table: %s --", serviceName)
+func resolveBinding(ctx context.Context, config *config, topoloyKey TopologyKey, minVersion *version.Version, maxVersion *version.Version, serviceName ServiceName) *binding {
 	vTable := config.mapping[serviceName]
 	if vTable == nil {
-		log.Printf("byway: Could not locate version table for service. %s", serviceName)
+		logger.DebugContext(ctx, "could not locate version table", "service", serviceName)
 		return nil
 	}
 
-	log.Printf("byway: Checking for topology %s", topoloyKey)
 	topology := config.topologies[topoloyKey]
 	if topology != nil {
-		log.Printf("byway: Checking for %s in topology table", string(serviceName))
-
 		specificVersion := topology[serviceName]
 
 		if specificVersion != "" {
-			log.Printf("byway: Topology definens specific version: %s:%s", string(serviceName), string(specificVersion))
+			logger.DebugContext(ctx, "topology defines specific version", "topology", topoloyKey, "service", serviceName, "version", specificVersion)
 
-			binding := vTable[specificVersion]
+			binding := vTable.bindings[specificVersion]
 			return &binding
 		}
 	}
 
-	log.Println("byway: Building version list ...")
-	vList := make([]*version.Version, 0)
-	for versionStr := range vTable {
-
-		v, err := version.NewVersion(string(versionStr))
-		if err != nil {
-			log.Printf("byway: Could not parse version: %s, %s", versionStr, err.Error())
-		} else {
-			vList = append(vList, v)
-		}
-	}
-
-	log.Println("byway: Sorting version list ...")
-
-	sort.Sort(version.Collection(vList))
-	log.Printf("byway: Version list: %s", vList)
-
 	constraint := bulidContraint(minVersion, maxVersion)
-	log.Printf("byway: Version constraint:  %s", constraint)
+	logger.DebugContext(ctx, "resolving version", "service", serviceName, "versions", vTable.versions, "constraint", constraint)
 
-	for i := len(vList) - 1; i >= 0; i-- {
-		v := vList[i]
+	for i := len(vTable.versions) - 1; i >= 0; i-- {
+		v := vTable.versions[i]
 
-		if v != nil && constraint.Check(v) {
-			log.Printf("byway: Accepted: %s", v)
-			binding := vTable[VersionString(v.String())]
-			return &binding
+		if constraint.Check(v) {
+			logger.DebugContext(ctx, "accepted version", "version", v)
+			return vTable.sorted[i]
 		}
-		log.Printf("byway: Rejected: %s", v)
+		logger.DebugContext(ctx, "rejected version", "version", v)
 
 	}
 
-	log.Printf("byway: Could not resolve binding for: %s %s  ", serviceName, constraint)
+	logger.DebugContext(ctx, "could not resolve binding", "service", serviceName, "constraint", constraint)
 
 	return nil
 }
 
-func newBywayProxy(configChan chan *Config) *httputil.ReverseProxy {
-	config := &config{}
+// proxyState - the config currently served by the proxy. Configs are
+// immutable once mapped, so requests load one snapshot and use it throughout
+type proxyState struct {
+	current    atomic.Pointer[config]
+	accessLogs accessLogs
+	tracing    tracing
+}
 
-	go func() {
-		for {
-			rawConfig := <-configChan
-			config = mapConfig(rawConfig)
+func newProxyState() *proxyState {
+	state := &proxyState{}
+	state.current.Store(&config{})
+	return state
+}
+
+func (state *proxyState) config() *config {
+	return state.current.Load()
+}
+
+// resolveRoute - rewrites the request url and resolves its binding
+func resolveRoute(configSnapshot *config, listener listener, req *http.Request) resolvedRoute {
+	ctx := req.Context()
+	input := req.URL.String()
+	topologyKey := TopologyKey(req.Header.Get("x-byway-topology"))
+	if topologyKey == "" {
+		topologyKey = listener.topology
+	}
+	_, span := startSpan(ctx, "rewrite")
+	rewritten, err := rewriteURL(configSnapshot, req, topologyKey)
+	span.End()
+	if err != nil {
+		return resolvedRoute{err: err, failure: failureRewrite}
+	}
+	req.URL = rewritten
+	req.Host = req.URL.Host
+
+	_, span = startSpan(ctx, "extract")
+	topologyKey, minVersion, maxVersion, serviceName := extractRoutingParameters(req, listener)
+	span.End()
+
+	_, span = startSpan(ctx, "resolve")
+	binding := resolveBinding(ctx, configSnapshot, topologyKey, minVersion, maxVersion, serviceName)
+	span.End()
+
+	failure := ""
+	if binding != nil {
+		// rewrite again now the topology of the host is known, and any grammar
+		// prefix is stripped, so rules conditioned on them apply
+		_, span = startSpan(ctx, "rewrite")
+		rewritten, err := rewriteURL(configSnapshot, req, topologyKey)
+		span.End()
+		if err != nil {
+			return resolvedRoute{err: err, failure: failureRewrite}
 		}
-	}()
+		req.URL = rewritten
+	} else if configSnapshot.mapping[serviceName] == nil {
+		failure = failureUnknownService
+	} else {
+		failure = failureNoVersion
+	}
+
+	resolved := *req.URL
+	return resolvedRoute{
+		url:       &resolved,
+		host:      req.Host,
+		topology:  topologyKey,
+		binding:   binding,
+		rewritten: resolved.String() != input,
+		failure:   failure,
+	}
+}
 
+func newBywayProxy(state *proxyState) *httputil.ReverseProxy {
 	director := func(req *http.Request) {
-		configSnapshot := config
-		log.Println("byway: -----------ROUTE BEGIN-----------")
+		configSnapshot := state.config()
+		ctx := req.Context()
 
+		host := req.Host
 		req.URL.Host = req.Host
-		req.URL = rewriteURL(configSnapshot, req.URL)
-		req.Host = req.URL.Host
+		route := routeFromContext(ctx)
+		route.host = host
+		route.acceptEncoding = strings.Join(req.Header.Values("Accept-Encoding"), ",")
+
+		key, cacheable := newRouteKey(configSnapshot, route.listener, req)
+		resolved, hit := resolvedRoute{}, false
+		if cacheable && !debugEnabled(ctx) {
+			resolved, hit = resolutionCache.get(key)
+		}
+		if hit {
+			trace.SpanFromContext(ctx).AddEvent("route cache hit")
+		}
+		if !hit {
+			resolved = resolveRoute(configSnapshot, configSnapshot.listener(route.listener), req)
+			if cacheable {
+				resolutionCache.add(key, resolved)
+			}
+		}
 
-		topologyKey, minVersion, maxVersion, serviceName := extractRoutingParameters(req)
-		binding := resolveBinding(configSnapshot, topologyKey, minVersion, maxVersion, serviceName)
+		if resolved.err != nil {
+			route.err = resolved.err
+			route.failure = resolved.failure
+			logger.WarnContext(ctx, "route failed", "url", req.URL, "err", resolved.err)
+			return
+		}
+		rewritten := *resolved.url
+		req.URL = &rewritten
+		req.Host = resolved.host
+
+		binding := resolved.binding
+		route.binding = binding
+		route.rewritten = resolved.url
+		route.topology = resolved.topology
+		route.failure = resolved.failure
+		if resolved.rewritten {
+			metrics.rewrites.Inc()
+		}
+
+		route.clientIP = clientIP(configSnapshot, req)
+		forwarded := forwardXForwarded
+		if binding != nil {
+			forwarded = binding.forwarded
+		}
+		setForwardedHeaders(configSnapshot, forwarded, req, host)
 
 		if binding != nil {
-			req.URL = rewriteURL(config, req.URL)
+			route.authorized = req.Header.Get("Authorization") != ""
+			route.rateLimits = configSnapshot.matchRateLimits(req, route)
+			err := binding.body.limitRequest(req)
+			if err != nil {
+				route.err = err
+				logger.DebugContext(ctx, "request body rejected", "err", err)
+				return
+			}
 
-			req.Header.Add("X-Forwarded-Host", req.Host)
+			propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
 			if binding.pathRewriteFn != nil {
-				req.URL.Path = binding.pathRewriteFn(req.URL.Path)
+				path := binding.pathRewriteFn(req.URL.Path)
+				if path != req.URL.Path {
+					logger.DebugContext(ctx, "binding rewrite", "from", req.URL.Path, "to", path)
+					req.URL.Path = path
+					req.URL.RawPath = ""
+				}
 			}
 			req.URL.Scheme = binding.scheme
 			req.URL.Host = binding.host
-			req.Host = binding.headers["host"]
-			if req.Host == "" {
-				req.Host = binding.host
+			req.Host = binding.host
+			if binding.responseRewrite != nil && binding.responseRewrite.body != nil {
+				// bodies to rewrite must arrive uncompressed, the transport
+				// negotiates and decodes its own compression instead
+				req.Header.Del("Accept-Encoding")
 			}
 
-			log.Printf("byway: Routing to %s\nHost Header: %s", req.URL, binding.headers["host"])
+			binding.requestHeaders.apply(req.Header, newHeaderValues(req, route))
+			if host := req.Header.Get("Host"); host != "" {
+				req.Host = host
+				req.Header.Del("Host")
+			}
 
+			logger.DebugContext(ctx, "routing", "upstream", req.URL, "host", req.Host, "cached", hit)
+		} else {
+			logger.DebugContext(ctx, "no binding", "host", req.Host, "cached", hit)
 		}
-		log.Println("byway: -----------ROUTE END-----------")
 	}
 
-	return &httputil.ReverseProxy{Director: director}
+	return &httputil.ReverseProxy{
+		Director:       director,
+		Transport:      &bywayTransport{http.DefaultTransport},
+		ModifyResponse: modifyResponse,
+		ErrorHandler:   proxyErrorHandler,
+	}
+}
+
+// newBywayHandler answers redirects and proxies everything else
+func newBywayHandler(state *proxyState) http.Handler {
+	proxy := withFlushInterval(newBywayProxy(state))
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if redirect(state.config(), w, req) {
+			return
+		}
+		proxy.ServeHTTP(w, req)
+	})
 }
 
 // Init run the router
 func Init(serviceTable chan *Config, exit chan bool) {
-	go func() {
-		port := ":1090"
-		fmt.Printf("Running on " + port + "!\n")
-		proxy := newBywayProxy(serviceTable)
+	state := newProxyState()
+	listeners := newListenerSet(state, newBywayHandler(state))
+	admin := &adminServer{}
+	var generation uint64
 
-		err := http.ListenAndServe(port, proxy)
-		if err != nil {
-			log.Fatal(err)
+	go func() {
+		for {
+			rawConfig := <-serviceTable
+			newConfig, err := mapConfig(rawConfig)
+			if err != nil {
+				logger.Error("rejected config, keeping last good config", "err", err)
+				metrics.configRejected()
+				continue
+			}
+			err = ApplyLoggingConfig(rawConfig.Logging)
+			if err != nil {
+				logger.Error("could not apply logging config", "err", err)
+			}
+			err = state.accessLogs.apply(rawConfig.AccessLog)
+			if err != nil {
+				logger.Error("could not open access log", "err", err)
+			}
+			err = state.tracing.apply(rawConfig.Tracing)
+			if err != nil {
+				logger.Error("could not start tracing", "err", err)
+			}
+			httpCache.apply(rawConfig.Cache)
+			generation++
+			newConfig.generation = generation
+			resolutionCache.reset(routeCacheSize(rawConfig.RouteCache))
+			state.current.Store(newConfig)
+			currentResolver.Store(&HostResolver{config: newConfig})
+			metrics.configAccepted(generation)
+			listeners.reconcile(rawConfig.Listeners)
+			admin.reconcile(rawConfig.Admin)
 		}
 	}()
 }
@@ -0,0 +1,196 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ForwardedConfig - proxies trusted to describe the client in X-Forwarded-*
+// and Forwarded headers. Those headers are stripped from every other client
+type ForwardedConfig struct {
+	Trusted []string `json:"trusted" yaml:"trusted"`
+}
+
+// forwarded header styles a binding may receive
+const (
+	forwardXForwarded byte = 1 << iota
+	forwardForwarded
+)
+
+var forwardedHeaders = []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Forwarded-Port", "Forwarded"}
+
+// forwardedStyle parses an EndpointConfig.ForwardedHeaders value: x-forwarded
+// (the default), forwarded (RFC 7239), both or none
+func forwardedStyle(style string) (byte, error) {
+	switch strings.ToLower(style) {
+	case "", "x-forwarded":
+		return forwardXForwarded, nil
+	case "forwarded":
+		return forwardForwarded, nil
+	case "both":
+		return forwardXForwarded | forwardForwarded, nil
+	case "none":
+		return 0, nil
+	}
+	return 0, fmt.Errorf("unknown forwarded_headers style: %s", style)
+}
+
+// setForwardedHeaders describes the client of req to the upstream in the
+// styles given, continuing the chain only when the peer is a trusted proxy.
+// The peer itself is appended to X-Forwarded-For by httputil.ReverseProxy
+func setForwardedHeaders(config *config, styles byte, req *http.Request, host string) {
+	peer := net.ParseIP(remoteHost(req.RemoteAddr))
+	if !trustedForwarder(config, remoteHost(req.RemoteAddr)) {
+		for _, header := range forwardedHeaders {
+			req.Header.Del(header)
+		}
+	}
+
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	if styles&forwardXForwarded != 0 {
+		setDefaultHeader(req.Header, "X-Forwarded-Host", host)
+		setDefaultHeader(req.Header, "X-Forwarded-Proto", proto)
+		if port := localPort(req); port != "" {
+			setDefaultHeader(req.Header, "X-Forwarded-Port", port)
+		}
+	} else {
+		req.Header.Del("X-Forwarded-Host")
+		req.Header.Del("X-Forwarded-Proto")
+		req.Header.Del("X-Forwarded-Port")
+		req.Header["X-Forwarded-For"] = nil
+	}
+
+	if styles&forwardForwarded != 0 {
+		element := fmt.Sprintf("for=%s;host=%s;proto=%s", forwardedNode(peer), quoteForwarded(host), proto)
+		prior := req.Header.Values("Forwarded")
+		req.Header.Set("Forwarded", strings.Join(append(prior, element), ", "))
+	} else {
+		req.Header.Del("Forwarded")
+	}
+}
+
+// clientIP - the address of the client of req. Behind trusted proxies it is
+// the last address of X-Forwarded-For, or else Forwarded, which is not itself
+// a trusted proxy
+func clientIP(config *config, req *http.Request) string {
+	peer := remoteHost(req.RemoteAddr)
+	if !trustedForwarder(config, peer) {
+		return peer
+	}
+	chain := forwardedFor(req.Header)
+	for i := len(chain) - 1; i >= 0; i-- {
+		if !trustedForwarder(config, chain[i]) {
+			return chain[i]
+		}
+	}
+	if len(chain) > 0 {
+		return chain[0]
+	}
+	return peer
+}
+
+func trustedForwarder(config *config, host string) bool {
+	ip := net.ParseIP(host)
+	return ip != nil && containsAddr(config.forwardedTrusted, &net.TCPAddr{IP: ip})
+}
+
+// forwardedFor - the chain of client addresses in X-Forwarded-For, or the
+// for parameters of Forwarded. Ports are dropped, as are obfuscated and
+// unknown nodes, which are not addresses
+func forwardedFor(header http.Header) []string {
+	var chain []string
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, node := range strings.Split(value, ",") {
+			if ip := forwardedIP(node); ip != "" {
+				chain = append(chain, ip)
+			}
+		}
+	}
+	if len(chain) > 0 {
+		return chain
+	}
+
+	for _, value := range header.Values("Forwarded") {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				name, node, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				if !strings.EqualFold(name, "for") {
+					continue
+				}
+				if ip := forwardedIP(node); ip != "" {
+					chain = append(chain, ip)
+				}
+			}
+		}
+	}
+	return chain
+}
+
+// forwardedIP - the address of a node, as 192.0.2.1, 192.0.2.1:80, [2001:db8::1]
+// or "[2001:db8::1]:80", or "" for anything else
+func forwardedIP(node string) string {
+	node = strings.Trim(strings.TrimSpace(node), `"`)
+	if strings.HasPrefix(node, "[") {
+		node, _, _ = strings.Cut(node[1:], "]")
+	} else if strings.Count(node, ":") == 1 {
+		node, _, _ = strings.Cut(node, ":")
+	}
+	ip := net.ParseIP(node)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+func setDefaultHeader(header http.Header, name string, value string) {
+	if header.Get(name) == "" {
+		header.Set(name, value)
+	}
+}
+
+func remoteHost(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// localPort - the port of the listener which accepted req
+func localPort(req *http.Request) string {
+	addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return ""
+	}
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	return port
+}
+
+// forwardedNode formats a client for the Forwarded header, RFC 7239 section 6
+func forwardedNode(ip net.IP) string {
+	if ip == nil {
+		return "unknown"
+	}
+	if ip.To4() == nil {
+		return `"[` + ip.String() + `]"`
+	}
+	return ip.String()
+}
+
+func quoteForwarded(value string) string {
+	for _, c := range value {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+		}
+	}
+	return value
+}
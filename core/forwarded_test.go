@@ -0,0 +1,48 @@
+package core
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseCIDRs([]string{"10.0.0.0/8", "2001:db8:ffff::/48"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &config{forwardedTrusted: trusted}
+
+	tests := []struct {
+		name     string
+		peer     string
+		header   string
+		value    string
+		expected string
+	}{
+		{"untrusted peer", "192.0.2.9:1234", "X-Forwarded-For", "198.51.100.1", "192.0.2.9"},
+		{"untrusted peer with Forwarded", "192.0.2.9:1234", "Forwarded", "for=198.51.100.1", "192.0.2.9"},
+		{"trusted peer without headers", "10.0.0.1:1234", "", "", "10.0.0.1"},
+		{"trusted peer", "10.0.0.1:1234", "X-Forwarded-For", "198.51.100.1", "198.51.100.1"},
+		{"several hops", "10.0.0.1:1234", "X-Forwarded-For", "203.0.113.7, 198.51.100.1, 10.0.0.2", "198.51.100.1"},
+		{"spoofed first hop", "10.0.0.1:1234", "X-Forwarded-For", "10.0.0.3, 198.51.100.1", "198.51.100.1"},
+		{"every hop trusted", "10.0.0.1:1234", "X-Forwarded-For", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		{"address with port", "10.0.0.1:1234", "X-Forwarded-For", "198.51.100.1:4711", "198.51.100.1"},
+		{"not an address", "10.0.0.1:1234", "X-Forwarded-For", "198.51.100.1, garbage", "198.51.100.1"},
+		{"Forwarded", "10.0.0.1:1234", "Forwarded", "for=198.51.100.1;proto=https, for=10.0.0.2", "198.51.100.1"},
+		{"Forwarded ipv6 with port", "10.0.0.1:1234", "Forwarded", `for="[2001:DB8::1]:4711"`, "2001:db8::1"},
+		{"Forwarded trusted ipv6", "10.0.0.1:1234", "Forwarded", `for=198.51.100.1, for="[2001:db8:ffff::1]"`, "198.51.100.1"},
+		{"Forwarded unknown", "10.0.0.1:1234", "Forwarded", "for=198.51.100.1, for=unknown", "198.51.100.1"},
+		{"Forwarded obfuscated", "10.0.0.1:1234", "Forwarded", "for=_hidden, for=_secret", "10.0.0.1"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "http://echo.example.com/", nil)
+		req.RemoteAddr = test.peer
+		if test.header != "" {
+			req.Header.Set(test.header, test.value)
+		}
+		if ip := clientIP(config, req); ip != test.expected {
+			t.Errorf("%s: client was %q, expected %q", test.name, ip, test.expected)
+		}
+	}
+}
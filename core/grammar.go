@@ -0,0 +1,174 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// grammar - a compiled routing grammar. Templates are written as a host part,
+// optionally followed by a path prefix part, eg:
+//
+//	{service}--{version}.apps.example.com
+//	[t-{topology}.]{service}.svc
+//	api.example.com/{service}/v{version}
+//
+// Placeholders are {service}, {topology}, {version}, {min} and {max}; text in
+// square brackets is optional. A matched path prefix is stripped from the path.
+type grammar struct {
+	template string
+	host     *regexp.Regexp
+	path     *regexp.Regexp
+}
+
+var grammarPlaceholders = map[string]bool{
+	"service":  true,
+	"topology": true,
+	"version":  true,
+	"min":      true,
+	"max":      true,
+}
+
+func compileGrammar(template string) (*grammar, error) {
+	hostTemplate, pathTemplate := template, ""
+	if i := strings.Index(template, "/"); i >= 0 {
+		hostTemplate, pathTemplate = template[:i], template[i:]
+	}
+
+	g := &grammar{template: template}
+	seen := make(map[string]bool)
+
+	if hostTemplate != "" {
+		expr, err := compileGrammarPart(hostTemplate, 0, '.', seen)
+		if err != nil {
+			return nil, fmt.Errorf("grammar %q: %s", template, err)
+		}
+		g.host = regexp.MustCompile("(?i)^" + expr + "$")
+	}
+
+	if pathTemplate != "" {
+		expr, err := compileGrammarPart(pathTemplate, len(hostTemplate), '/', seen)
+		if err != nil {
+			return nil, fmt.Errorf("grammar %q: %s", template, err)
+		}
+		g.path = regexp.MustCompile("^" + strings.TrimSuffix(expr, "/") + "(?:/|$)")
+	}
+
+	if !seen["service"] {
+		return nil, fmt.Errorf("grammar %q: missing {service}", template)
+	}
+	if seen["version"] && (seen["min"] || seen["max"]) {
+		return nil, fmt.Errorf("grammar %q: {version} cannot be combined with {min} or {max}", template)
+	}
+
+	return g, nil
+}
+
+func compileGrammarPart(template string, offset int, separator byte, seen map[string]bool) (string, error) {
+	var expr strings.Builder
+	depth := 0
+
+	for i := 0; i < len(template); i++ {
+		switch c := template[i]; c {
+		case '{':
+			end := strings.IndexByte(template[i:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated placeholder at offset %d", offset+i)
+			}
+			name := template[i+1 : i+end]
+			if !grammarPlaceholders[name] {
+				return "", fmt.Errorf("unknown placeholder {%s} at offset %d", name, offset+i)
+			}
+			if seen[name] {
+				return "", fmt.Errorf("duplicate placeholder {%s} at offset %d", name, offset+i)
+			}
+			seen[name] = true
+
+			value := "[^" + regexp.QuoteMeta(string(separator)) + "]+?"
+			if name == "version" || name == "min" || name == "max" {
+				// digits joined by whichever of . and - do not separate parts
+				joiners := strings.ReplaceAll("[.-]", string(separator), "")
+				value = "[0-9]+(?:" + joiners + "[0-9]+)*"
+			}
+			fmt.Fprintf(&expr, "(?P<%s>%s)", name, value)
+			i += end
+		case '}':
+			return "", fmt.Errorf("unexpected } at offset %d", offset+i)
+		case '[':
+			depth++
+			expr.WriteString("(?:")
+		case ']':
+			depth--
+			if depth < 0 {
+				return "", fmt.Errorf("unexpected ] at offset %d", offset+i)
+			}
+			expr.WriteString(")?")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	if depth != 0 {
+		return "", fmt.Errorf("unterminated optional group")
+	}
+	return expr.String(), nil
+}
+
+func compileGrammars(templates []string) ([]*grammar, error) {
+	grammars := make([]*grammar, 0)
+	for _, template := range templates {
+		g, err := compileGrammar(template)
+		if err != nil {
+			return nil, err
+		}
+		grammars = append(grammars, g)
+	}
+	return grammars, nil
+}
+
+func mustCompileGrammars(templates []string) []*grammar {
+	grammars, err := compileGrammars(templates)
+	if err != nil {
+		panic(err)
+	}
+	return grammars
+}
+
+// match returns the placeholder values of host and path, and the path with
+// any matched prefix removed
+func (g *grammar) match(host string, path string) (map[string]string, string, bool) {
+	values := make(map[string]string)
+
+	if g.host != nil {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !collectMatches(g.host, host, values) {
+			return nil, path, false
+		}
+	}
+
+	if g.path != nil {
+		loc := g.path.FindStringIndex(path)
+		if loc == nil || !collectMatches(g.path, path[:loc[1]], values) {
+			return nil, path, false
+		}
+		path = "/" + strings.TrimPrefix(path[loc[1]:], "/")
+	}
+
+	return values, path, true
+}
+
+func collectMatches(re *regexp.Regexp, input string, values map[string]string) bool {
+	match := re.FindStringSubmatch(input)
+	if match == nil {
+		return false
+	}
+	for i, name := range re.SubexpNames() {
+		if name != "" && match[i] != "" {
+			values[name] = match[i]
+		}
+	}
+	return true
+}
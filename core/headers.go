@@ -0,0 +1,193 @@
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// HeaderPolicy - edits applied to a set of headers: Remove, then Set, then
+// Append. Remove entries ending in * remove every header with that prefix.
+// Values may refer to the request as {client_ip}, {host}, {service},
+// {version}, {version_host} (1-0-2), {topology} or {request_id}, and to secrets as {env:NAME},
+// {file:PATH} (within BYWAY_SECRET_DIR) or {secret:NAME}
+type HeaderPolicy struct {
+	Set    map[string]string `json:"set,omitempty" yaml:"set,omitempty"`
+	Append map[string]string `json:"append,omitempty" yaml:"append,omitempty"`
+	Remove []string          `json:"remove,omitempty" yaml:"remove,omitempty"`
+}
+
+var headerTemplateFields = map[string]bool{
+	"client_ip":    true,
+	"host":         true,
+	"service":      true,
+	"version":      true,
+	"version_host": true,
+	"topology":     true,
+	"request_id":   true,
+}
+
+// headerTemplate - a header value, alternating literal text and field names
+type headerTemplate struct {
+	literals []string
+	fields   []string
+}
+
+type headerEdit struct {
+	name  string
+	value headerTemplate
+}
+
+type headerPolicy struct {
+	remove         []string
+	removePrefixes []string
+	set            []headerEdit
+	append         []headerEdit
+}
+
+// headerValues - what header templates may refer to
+type headerValues map[string]string
+
+// compileHeaderTemplate parses value, reading the secrets it refers to
+func compileHeaderTemplate(value string, secrets *secretStore) (headerTemplate, error) {
+	template := headerTemplate{}
+	var literal strings.Builder
+	for {
+		start := strings.IndexByte(value, '{')
+		if start < 0 {
+			literal.WriteString(value)
+			template.literals = append(template.literals, literal.String())
+			return template, nil
+		}
+		end := strings.IndexByte(value[start:], '}')
+		if end < 0 {
+			return headerTemplate{}, fmt.Errorf("unterminated placeholder at offset %d", start)
+		}
+		field := value[start+1 : start+end]
+		literal.WriteString(value[:start])
+		value = value[start+end+1:]
+
+		if isSecretReference(field) {
+			secret, err := secrets.resolve(field)
+			if err != nil {
+				return headerTemplate{}, err
+			}
+			literal.WriteString(secret)
+			continue
+		}
+		if !headerTemplateFields[field] {
+			return headerTemplate{}, fmt.Errorf("unknown placeholder {%s}", field)
+		}
+		template.literals = append(template.literals, literal.String())
+		template.fields = append(template.fields, field)
+		literal.Reset()
+	}
+}
+
+func (t headerTemplate) render(values headerValues) string {
+	if len(t.fields) == 0 {
+		return t.literals[0]
+	}
+	var b strings.Builder
+	for i, field := range t.fields {
+		b.WriteString(t.literals[i])
+		b.WriteString(values[field])
+	}
+	b.WriteString(t.literals[len(t.fields)])
+	return b.String()
+}
+
+func compileHeaderEdits(headers map[string]string, secrets *secretStore) ([]headerEdit, error) {
+	edits := make([]headerEdit, 0, len(headers))
+	for name, value := range headers {
+		template, err := compileHeaderTemplate(value, secrets)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		edits = append(edits, headerEdit{http.CanonicalHeaderKey(name), template})
+	}
+	sort.Slice(edits, func(i, j int) bool { return edits[i].name < edits[j].name })
+	return edits, nil
+}
+
+// mapHeaderPolicy compiles policy, with legacy set on top of its Set
+func mapHeaderPolicy(policy *HeaderPolicy, legacy map[string]string, secrets *secretStore) (*headerPolicy, error) {
+	if policy == nil {
+		policy = &HeaderPolicy{}
+	}
+	set := make(map[string]string)
+	for name, value := range legacy {
+		set[name] = value
+	}
+	for name, value := range policy.Set {
+		set[name] = value
+	}
+	if len(set) == 0 && len(policy.Append) == 0 && len(policy.Remove) == 0 {
+		return nil, nil
+	}
+
+	compiled := &headerPolicy{}
+	for _, name := range policy.Remove {
+		if strings.HasSuffix(name, "*") {
+			compiled.removePrefixes = append(compiled.removePrefixes, http.CanonicalHeaderKey(strings.TrimSuffix(name, "*")))
+		} else {
+			compiled.remove = append(compiled.remove, http.CanonicalHeaderKey(name))
+		}
+	}
+
+	var err error
+	compiled.set, err = compileHeaderEdits(set, secrets)
+	if err != nil {
+		return nil, fmt.Errorf("set.%s", err)
+	}
+	compiled.append, err = compileHeaderEdits(policy.Append, secrets)
+	if err != nil {
+		return nil, fmt.Errorf("append.%s", err)
+	}
+	return compiled, nil
+}
+
+// apply edits header, a Host set by the policy is left in header for the caller
+func (policy *headerPolicy) apply(header http.Header, values headerValues) {
+	if policy == nil {
+		return
+	}
+
+	for _, name := range policy.remove {
+		header.Del(name)
+	}
+	if len(policy.removePrefixes) > 0 {
+		for name := range header {
+			for _, prefix := range policy.removePrefixes {
+				if strings.HasPrefix(http.CanonicalHeaderKey(name), prefix) {
+					header.Del(name)
+					break
+				}
+			}
+		}
+	}
+
+	for _, edit := range policy.set {
+		header.Set(edit.name, edit.value.render(values))
+	}
+	for _, edit := range policy.append {
+		header.Add(edit.name, edit.value.render(values))
+	}
+}
+
+// newHeaderValues - the values header templates may refer to for req
+func newHeaderValues(req *http.Request, route *route) headerValues {
+	values := headerValues{
+		"client_ip":  route.clientIP,
+		"host":       route.host,
+		"topology":   string(route.topology),
+		"request_id": route.requestID,
+	}
+	if route.binding != nil {
+		values["service"] = string(route.binding.service)
+		values["version"] = string(route.binding.version)
+		values["version_host"] = strings.ReplaceAll(string(route.binding.version), ".", "-")
+	}
+	return values
+}
@@ -0,0 +1,140 @@
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newProxyTest - a proxy to upstream, bound as echo 1.0.0 with endpoint
+func newProxyTest(t *testing.T, endpoint EndpointConfig, upstream http.HandlerFunc) http.Handler {
+	t.Helper()
+	server := httptest.NewServer(upstream)
+	t.Cleanup(server.Close)
+
+	endpoint.Host = strings.TrimPrefix(server.URL, "http://")
+	endpoint.Scheme = "http"
+	rawConfig := NewConfig()
+	rawConfig.Mapping["echo"] = map[VersionString]EndpointConfig{"1.0.0": endpoint}
+	config, err := mapConfig(rawConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolutionCache.reset(routeCacheSize(nil))
+	state := newProxyState()
+	state.current.Store(config)
+	return withRoute(defaultListenerName, newBywayHandler(state))
+}
+
+// serveProxyTest - the response of handler to req, sent to echo 1.0.0
+func serveProxyTest(handler http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	req.Host = "1-0-0.1-0-0.echo.example.com"
+	req.RemoteAddr = "192.0.2.1:1234"
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestHeaderTemplates(t *testing.T) {
+	t.Setenv("BYWAY_TEST_TOKEN", "s3cret")
+	values := headerValues{"service": "echo", "version_host": "1-0-2", "client_ip": "192.0.2.1"}
+
+	for value, expected := range map[string]string{
+		"literal":                         "literal",
+		"{service}":                       "echo",
+		"{version_host}.echo.example.com": "1-0-2.echo.example.com",
+		"for={client_ip};by=byway":        "for=192.0.2.1;by=byway",
+		"Bearer {env:BYWAY_TEST_TOKEN}":   "Bearer s3cret",
+		"{topology}":                      "",
+	} {
+		template, err := compileHeaderTemplate(value, &secretStore{})
+		if err != nil {
+			t.Errorf("%s: %s", value, err)
+			continue
+		}
+		if rendered := template.render(values); rendered != expected {
+			t.Errorf("%s rendered as %q, expected %q", value, rendered, expected)
+		}
+	}
+
+	for _, value := range []string{"{unknown}", "{service", "{env:BYWAY_TEST_UNSET}", "{secret:missing}"} {
+		if _, err := compileHeaderTemplate(value, &secretStore{}); err == nil {
+			t.Errorf("%s: expected an error", value)
+		}
+	}
+}
+
+func TestHeaderPolicyApply(t *testing.T) {
+	policy, err := mapHeaderPolicy(&HeaderPolicy{
+		Set:    map[string]string{"x-served-by": "{service}/{version}", "host": "{version_host}.internal"},
+		Append: map[string]string{"via": "1.1 byway"},
+		Remove: []string{"cookie", "x-byway-*"},
+	}, map[string]string{"x-served-by": "legacy", "x-legacy": "kept"}, &secretStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := http.Header{
+		"Cookie":           {"session=1"},
+		"X-Byway-Debug":    {"1"},
+		"X-Byway-Topology": {"dev"},
+		"Via":              {"1.0 upstream"},
+		"Accept":           {"*/*"},
+	}
+	policy.apply(header, headerValues{"service": "echo", "version": "1.0.2", "version_host": "1-0-2"})
+
+	for name, expected := range map[string][]string{
+		"Cookie":           nil,
+		"X-Byway-Debug":    nil,
+		"X-Byway-Topology": nil,
+		"X-Served-By":      {"echo/1.0.2"},
+		"X-Legacy":         {"kept"},
+		"Host":             {"1-0-2.internal"},
+		"Via":              {"1.0 upstream", "1.1 byway"},
+		"Accept":           {"*/*"},
+	} {
+		if values := header.Values(name); strings.Join(values, "|") != strings.Join(expected, "|") {
+			t.Errorf("%s was %v, expected %v", name, values, expected)
+		}
+	}
+
+	for prefix, policy := range map[string]*HeaderPolicy{
+		"set.x-bad":    {Set: map[string]string{"x-bad": "{unknown}"}},
+		"append.x-bad": {Append: map[string]string{"x-bad": "{unknown}"}},
+	} {
+		_, err := mapHeaderPolicy(policy, nil, &secretStore{})
+		if err == nil || !strings.HasPrefix(err.Error(), prefix) {
+			t.Errorf("expected an error starting %q, got %v", prefix, err)
+		}
+	}
+}
+
+func TestHeaderPoliciesOfBindings(t *testing.T) {
+	var received http.Header
+	handler := newProxyTest(t, EndpointConfig{
+		RequestHeaders: &HeaderPolicy{
+			Set:    map[string]string{"x-client-ip": "{client_ip}", "x-route": "{service}@{version}"},
+			Remove: []string{"cookie"},
+		},
+		ResponseHeaders: &HeaderPolicy{
+			Set:    map[string]string{"x-served-by": "{service}/{version}"},
+			Remove: []string{"server"},
+		},
+	}, func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		w.Header().Set("Server", "upstream/1.0")
+	})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Cookie", "session=1")
+	resp := serveProxyTest(handler, req)
+
+	if received.Get("X-Client-Ip") != "192.0.2.1" || received.Get("X-Route") != "echo@1.0.0" || received.Get("Cookie") != "" {
+		t.Errorf("upstream received %v", received)
+	}
+	if resp.Header().Get("X-Served-By") != "echo/1.0.0" || resp.Header().Get("Server") != "" {
+		t.Errorf("client received %v", resp.Header())
+	}
+}
@@ -0,0 +1,265 @@
+package core
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+const defaultListenerName = "default"
+const defaultListenerAddress = ":1090"
+
+// pathGrammars - the grammars of listeners routing on the path, eg:
+// /echo/v1.0.1/rest or /_byway/t/dev/echo/rest
+var pathGrammars = mustCompileGrammars([]string{
+	"/_byway/t/{topology}/{service}[/v{version}]",
+	"/{service}[/v{version}]",
+})
+
+func mapListenerConfig(listenerConfig ListenerConfig, defaultGrammars []*grammar) (listener, error) {
+	suffixes := make([]string, 0)
+	for _, domain := range listenerConfig.Domains {
+		suffixes = append(suffixes, "."+strings.Trim(strings.ToLower(domain), "."))
+	}
+
+	grammars, err := compileGrammars(listenerConfig.Grammars)
+	if err != nil {
+		return listener{}, err
+	}
+	if len(grammars) == 0 {
+		grammars = defaultGrammars
+	}
+
+	switch strings.ToLower(listenerConfig.Protocol) {
+	case "", "http":
+	case "https":
+		if listenerConfig.CertFile == "" || listenerConfig.KeyFile == "" {
+			return listener{}, fmt.Errorf("cert_file and key_file are required for https")
+		}
+	default:
+		return listener{}, fmt.Errorf("unknown protocol: %s", listenerConfig.Protocol)
+	}
+
+	switch strings.ToLower(listenerConfig.Routing) {
+	case "", "host":
+	case "path":
+		grammars = append(grammars[:len(grammars):len(grammars)], pathGrammars...)
+	default:
+		return listener{}, fmt.Errorf("unknown routing mode: %s", listenerConfig.Routing)
+	}
+
+	return listener{
+		suffixes: suffixes,
+		topology: listenerConfig.Topology,
+		grammars: grammars,
+	}, nil
+}
+
+// listener returns the named listener, or the defaults for unnamed listeners
+func (config *config) listener(name string) listener {
+	if l, ok := config.listeners[name]; ok {
+		return l
+	}
+	return listener{grammars: config.grammars}
+}
+
+// stripHostSuffix removes the first matching suffix, and any port, from host.
+// Hosts outside every suffix are returned untouched
+func stripHostSuffix(host string, suffixes []string) string {
+	hostname := strings.ToLower(host)
+	if h, _, err := net.SplitHostPort(hostname); err == nil {
+		hostname = h
+	}
+
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(hostname, suffix) && len(hostname) > len(suffix) {
+			return hostname[:len(hostname)-len(suffix)]
+		}
+	}
+	return host
+}
+
+// HostResolver - reports which hosts the listeners of a config route to a
+// known service, for the dns server to answer for
+type HostResolver struct {
+	config *config
+}
+
+var currentResolver atomic.Pointer[HostResolver]
+
+// CurrentResolver - the resolver of the config the proxy is serving, which
+// resolves nothing until a config is accepted
+func CurrentResolver() *HostResolver {
+	if resolver := currentResolver.Load(); resolver != nil {
+		return resolver
+	}
+	return &HostResolver{config: &config{}}
+}
+
+// Resolves reports whether any listener routes host to a known service
+func (r *HostResolver) Resolves(host string) bool {
+	listeners := r.config.listeners
+	if len(listeners) == 0 {
+		listeners = map[string]listener{defaultListenerName: r.config.listener(defaultListenerName)}
+	}
+	for _, listener := range listeners {
+		if r.resolvesOn(listener, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *HostResolver) resolvesOn(listener listener, host string) bool {
+	host = stripHostSuffix(host, listener.suffixes)
+	for _, grammar := range listener.grammars {
+		if grammar.host == nil {
+			// routed on the path alone, so every host reaches a service
+			return true
+		}
+		values := make(map[string]string)
+		if !collectMatches(grammar.host, host, values) {
+			continue
+		}
+		if values["service"] == "" {
+			// the service is in the path
+			return true
+		}
+		return r.known(TopologyKey(values["topology"]), ServiceName(values["service"]), values["version"], values["min"], values["max"])
+	}
+
+	// the default layout: [t-<topology>.][<min>.][<max>.]<service>
+	components := strings.Split(host, ".")
+	var topologyKey TopologyKey
+	if strings.HasPrefix(components[0], "t-") {
+		topologyKey = TopologyKey(components[0][2:])
+		components = components[1:]
+	}
+	versions := make([]string, 0)
+	for len(versions) < 2 && len(components) > 0 && versionify(components[0]) != nil {
+		versions = append(versions, components[0])
+		components = components[1:]
+	}
+	if len(components) == 0 {
+		return false
+	}
+	return r.known(topologyKey, ServiceName(components[0]), versions...)
+}
+
+func (r *HostResolver) known(topologyKey TopologyKey, service ServiceName, versions ...string) bool {
+	if _, ok := r.config.mapping[service]; !ok {
+		return false
+	}
+	if _, ok := r.config.topologies[topologyKey]; topologyKey != "" && !ok {
+		return false
+	}
+	for _, v := range versions {
+		if v != "" && versionify(v) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// listenerSet - the listeners currently accepting connections
+type listenerSet struct {
+	state   *proxyState
+	handler http.Handler
+	running map[string]runningListener
+}
+
+type runningListener struct {
+	config ListenerConfig
+	server *http.Server
+}
+
+func newListenerSet(state *proxyState, handler http.Handler) *listenerSet {
+	return &listenerSet{
+		state:   state,
+		handler: handler,
+		running: make(map[string]runningListener),
+	}
+}
+
+func sameSocket(a ListenerConfig, b ListenerConfig) bool {
+	return a.Address == b.Address && a.Protocol == b.Protocol && a.CertFile == b.CertFile && a.KeyFile == b.KeyFile
+}
+
+// reconcile starts configured listeners which are not yet running and closes
+// running listeners which are no longer configured
+func (set *listenerSet) reconcile(listenerConfigs map[string]ListenerConfig) {
+	if len(listenerConfigs) == 0 {
+		listenerConfigs = map[string]ListenerConfig{defaultListenerName: {Address: defaultListenerAddress}}
+	}
+
+	for name, running := range set.running {
+		listenerConfig, ok := listenerConfigs[name]
+		if !ok || !sameSocket(listenerConfig, running.config) {
+			logger.Info("closing listener", "listener", name, "address", running.config.Address)
+			running.server.Close()
+			delete(set.running, name)
+		}
+	}
+
+	for name, listenerConfig := range listenerConfigs {
+		if _, ok := set.running[name]; ok {
+			continue
+		}
+		server, err := set.listen(name, listenerConfig)
+		if err != nil {
+			logger.Error("could not start listener", "listener", name, "err", err)
+			continue
+		}
+		set.running[name] = runningListener{config: listenerConfig, server: server}
+	}
+}
+
+func (set *listenerSet) listen(name string, listenerConfig ListenerConfig) (*http.Server, error) {
+	network, address := "tcp", listenerConfig.Address
+	if strings.HasPrefix(address, "unix:") {
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+		// remove the socket left by an earlier run, and nothing else
+		info, err := os.Lstat(address)
+		if err == nil {
+			if info.Mode()&os.ModeSocket == 0 {
+				return nil, fmt.Errorf("%s exists and is not a socket", address)
+			}
+			os.Remove(address)
+		}
+	}
+
+	socket, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	socket = newProxyProtocolListener(socket, set.state)
+
+	handler := withAccessLog(&set.state.accessLogs, set.handler)
+	handler = withMetrics(set.state, handler)
+	handler = withTracing(&set.state.tracing, handler)
+	handler = withRequestID(set.state, handler)
+	handler = withDebugLogging(set.state, withRoute(name, handler))
+	server := &http.Server{Handler: handler}
+	if strings.EqualFold(listenerConfig.Protocol, "https") {
+		certificate, err := tls.LoadX509KeyPair(listenerConfig.CertFile, listenerConfig.KeyFile)
+		if err != nil {
+			socket.Close()
+			return nil, err
+		}
+		socket = tls.NewListener(socket, &tls.Config{Certificates: []tls.Certificate{certificate}})
+	}
+
+	logger.Info("listening", "listener", name, "address", listenerConfig.Address)
+	go func() {
+		err := server.Serve(socket)
+		if err != nil && err != http.ErrServerClosed {
+			logger.Error("listener failed", "listener", name, "err", err)
+		}
+	}()
+
+	return server, nil
+}
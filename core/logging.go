@@ -0,0 +1,208 @@
+package core
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+const defaultDebugHeader = "X-Byway-Debug"
+
+// LoggingConfig - level and format of the log. DebugHeader names a request
+// header that turns on debug logging for that request only, "none" disables
+// it. The header is honoured when its value is DebugToken or, without a
+// token, only from the trusted proxies of Config.Forwarded
+type LoggingConfig struct {
+	Level       string `json:"level,omitempty" yaml:"level,omitempty"`
+	Format      string `json:"format,omitempty" yaml:"format,omitempty"`
+	DebugHeader string `json:"debug_header,omitempty" yaml:"debug_header,omitempty"`
+	DebugToken  string `json:"debug_token,omitempty" yaml:"debug_token,omitempty"`
+}
+
+type debugContextKey struct{}
+
+// debugRequests - how requests ask for debug logging
+type debugRequests struct {
+	header string
+	token  string
+}
+
+var (
+	logLevel    = new(slog.LevelVar)
+	configLevel atomic.Pointer[string]
+	logOutput   atomic.Pointer[slog.Handler]
+	debugSwitch atomic.Pointer[debugRequests]
+	logger      = slog.New(&logHandler{})
+)
+
+func init() {
+	setLogOutput(os.Stderr, "text")
+	debugSwitch.Store(&debugRequests{header: defaultDebugHeader})
+}
+
+// Logger - the byway logger, its level and format follow the live config
+func Logger() *slog.Logger {
+	return logger
+}
+
+// SetLogLevel - changes the level of the byway logger
+func SetLogLevel(level string) error {
+	parsed, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(parsed)
+	return nil
+}
+
+// LogLevel - the current level of the byway logger
+func LogLevel() string {
+	return strings.ToLower(logLevel.Level().String())
+}
+
+// ApplyLoggingConfig - applies the format and debug header of cfg, and its
+// level when set and changed since the last config, so a level set at runtime
+// lasts until the config sets another
+func ApplyLoggingConfig(cfg *LoggingConfig) error {
+	if cfg == nil {
+		cfg = &LoggingConfig{}
+	}
+	err := validateLoggingConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	if cfg.Level != "" {
+		if last := configLevel.Swap(&cfg.Level); last == nil || *last != cfg.Level {
+			SetLogLevel(cfg.Level)
+		}
+	}
+	setLogOutput(os.Stderr, cfg.Format)
+
+	header := cfg.DebugHeader
+	if header == "" {
+		header = defaultDebugHeader
+	}
+	if header == "none" {
+		header = ""
+	}
+	debugSwitch.Store(&debugRequests{header: http.CanonicalHeaderKey(header), token: cfg.DebugToken})
+	return nil
+}
+
+func validateLoggingConfig(cfg *LoggingConfig) error {
+	_, err := parseLogLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+	switch cfg.Format {
+	case "", "text", "json":
+		return nil
+	}
+	return fmt.Errorf("unknown format %s", cfg.Format)
+}
+
+func parseLogLevel(level string) (slog.Level, error) {
+	if level == "" {
+		return slog.LevelInfo, nil
+	}
+	var parsed slog.Level
+	err := parsed.UnmarshalText([]byte(level))
+	if err != nil {
+		return 0, fmt.Errorf("unknown level %s", level)
+	}
+	return parsed, nil
+}
+
+func setLogOutput(w io.Writer, format string) {
+	options := &slog.HandlerOptions{Level: slog.LevelDebug}
+	var handler slog.Handler
+	if format == "json" {
+		handler = slog.NewJSONHandler(w, options)
+	} else {
+		handler = slog.NewTextHandler(w, options)
+	}
+	logOutput.Store(&handler)
+}
+
+// withDebugLogging - turns on debug logging for requests carrying the debug
+// header with the debug token, or from trusted proxies. The header is
+// internal to byway and is not passed upstream
+func withDebugLogging(state *proxyState, inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		debug := debugSwitch.Load()
+		if debug.header == "" {
+			inner.ServeHTTP(w, req)
+			return
+		}
+		value := req.Header.Get(debug.header)
+		if value != "" {
+			req.Header.Del(debug.header)
+			if debug.allows(state.config(), req, value) {
+				req = req.WithContext(context.WithValue(req.Context(), debugContextKey{}, true))
+			}
+		}
+		inner.ServeHTTP(w, req)
+	})
+}
+
+func (debug *debugRequests) allows(config *config, req *http.Request, value string) bool {
+	if debug.token != "" {
+		return subtle.ConstantTimeCompare([]byte(value), []byte(debug.token)) == 1
+	}
+	return config != nil && trustedForwarder(config, remoteHost(req.RemoteAddr))
+}
+
+func debugEnabled(ctx context.Context) bool {
+	return logger.Enabled(ctx, slog.LevelDebug)
+}
+
+// logHandler - writes to the current output at the current level, or at
+// debug level for requests that asked for it
+type logHandler struct {
+	derive []func(slog.Handler) slog.Handler
+}
+
+func (h *logHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if level >= logLevel.Level() {
+		return true
+	}
+	return ctx != nil && ctx.Value(debugContextKey{}) != nil
+}
+
+func (h *logHandler) Handle(ctx context.Context, record slog.Record) error {
+	if ctx != nil {
+		if route, ok := ctx.Value(routeContextKey{}).(*route); ok && route.requestID != "" {
+			record.AddAttrs(slog.String("request_id", route.requestID))
+		}
+	}
+	output := *logOutput.Load()
+	for _, derive := range h.derive {
+		output = derive(output)
+	}
+	return output.Handle(ctx, record)
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(output slog.Handler) slog.Handler {
+		return output.WithAttrs(attrs)
+	})
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(output slog.Handler) slog.Handler {
+		return output.WithGroup(name)
+	})
+}
+
+func (h *logHandler) with(derive func(slog.Handler) slog.Handler) slog.Handler {
+	chain := make([]func(slog.Handler) slog.Handler, len(h.derive), len(h.derive)+1)
+	copy(chain, h.derive)
+	return &logHandler{derive: append(chain, derive)}
+}
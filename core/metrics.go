@@ -0,0 +1,288 @@
+package core
+
+import (
+	"crypto/subtle"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// resolution failure reasons
+const (
+	failureRewrite        = "rewrite"
+	failureUnknownService = "unknown_service"
+	failureNoVersion      = "no_matching_version"
+)
+
+// AdminConfig - the address of the admin endpoint, which serves /metrics,
+// /debug/vars, /cache/purge and /log/level. Purging and setting the level
+// need an Authorization: Bearer header carrying Token, or without a token a
+// request from a loopback address
+type AdminConfig struct {
+	Address string `json:"address" yaml:"address"`
+	Token   string `json:"token,omitempty" yaml:"token,omitempty"`
+}
+
+type proxyMetrics struct {
+	registry           *prometheus.Registry
+	requests           *prometheus.CounterVec
+	duration           *prometheus.HistogramVec
+	responseSize       *prometheus.HistogramVec
+	upstreamErrors     *prometheus.CounterVec
+	rewrites           prometheus.Counter
+	resolutionFailures *prometheus.CounterVec
+	configReloads      *prometheus.CounterVec
+	configReloadTime   prometheus.Gauge
+	configGeneration   prometheus.Gauge
+	cacheRequests      *prometheus.CounterVec
+	rateLimited        *prometheus.CounterVec
+}
+
+var metrics = newProxyMetrics()
+
+func newProxyMetrics() *proxyMetrics {
+	requestLabels := []string{"service", "version", "topology", "code"}
+	m := &proxyMetrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "byway_requests_total",
+			Help: "Requests answered, by resolved binding and status class.",
+		}, requestLabels),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "byway_request_duration_seconds",
+			Help:    "Time taken to answer requests, by resolved binding and status class.",
+			Buckets: prometheus.DefBuckets,
+		}, requestLabels),
+		responseSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "byway_response_size_bytes",
+			Help:    "Size of response bodies, by resolved binding and status class.",
+			Buckets: prometheus.ExponentialBuckets(100, 10, 7),
+		}, requestLabels),
+		upstreamErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "byway_upstream_errors_total",
+			Help: "Requests which could not be proxied to their upstream, by binding.",
+		}, []string{"service", "version", "upstream"}),
+		rewrites: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "byway_rewrites_total",
+			Help: "Requests whose url was changed by a rewrite.",
+		}),
+		resolutionFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "byway_resolution_failures_total",
+			Help: "Requests which could not be resolved to a binding, by reason.",
+		}, []string{"reason"}),
+		configReloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "byway_config_reloads_total",
+			Help: "Configs received, by whether they were accepted or rejected.",
+		}, []string{"result"}),
+		configReloadTime: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "byway_config_last_reload_timestamp_seconds",
+			Help: "Time the current config was accepted.",
+		}),
+		configGeneration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "byway_config_generation",
+			Help: "Generation of the current config.",
+		}),
+		cacheRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "byway_cache_requests_total",
+			Help: "Requests to bindings with caching, by whether they were answered from the cache.",
+		}, []string{"result"}),
+		rateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "byway_rate_limited_total",
+			Help: "Requests answered with 429, by the rate limit rule they exceeded.",
+		}, []string{"rule"}),
+	}
+
+	m.registry.MustRegister(
+		m.requests, m.duration, m.responseSize, m.upstreamErrors, m.rewrites,
+		m.resolutionFailures, m.configReloads, m.configReloadTime, m.configGeneration,
+		m.cacheRequests, m.rateLimited,
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "byway_route_cache_hits_total",
+			Help: "Route resolutions answered from the route cache.",
+		}, func() float64 { return float64(GetRouteCacheStats().Hits) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "byway_route_cache_misses_total",
+			Help: "Route resolutions missing from the route cache.",
+		}, func() float64 { return float64(GetRouteCacheStats().Misses) }),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// configAccepted records the generation and time of a newly served config
+func (m *proxyMetrics) configAccepted(generation uint64) {
+	m.configReloads.WithLabelValues("accepted").Inc()
+	m.configReloadTime.SetToCurrentTime()
+	m.configGeneration.Set(float64(generation))
+}
+
+func (m *proxyMetrics) configRejected() {
+	m.configReloads.WithLabelValues("rejected").Inc()
+}
+
+func statusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// withMetrics counts every request against the binding it was routed to.
+// Topologies only become labels when the config declares them, so clients
+// can not grow the label set with made up x-byway-topology headers
+func withMetrics(state *proxyState, inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := &responseRecorder{ResponseWriter: w}
+		inner.ServeHTTP(recorder, req)
+
+		route := routeFromContext(req.Context())
+		var service, version, topology string
+		if route.binding != nil {
+			service, version = string(route.binding.service), string(route.binding.version)
+		}
+		if route.topology != "" && state.config().topologies[route.topology] != nil {
+			topology = string(route.topology)
+		}
+		if route.failure != "" {
+			metrics.resolutionFailures.WithLabelValues(route.failure).Inc()
+		}
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		labels := prometheus.Labels{"service": service, "version": version, "topology": topology, "code": statusClass(status)}
+		metrics.requests.With(labels).Inc()
+		metrics.duration.With(labels).Observe(time.Since(start).Seconds())
+		metrics.responseSize.With(labels).Observe(float64(recorder.bytes))
+	})
+}
+
+// adminServer - serves metrics on the admin address of the live config
+type adminServer struct {
+	address string
+	server  *http.Server
+	token   atomic.Pointer[string]
+}
+
+func (admin *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{}))
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/cache/purge", admin.authorizeChanges(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		service := req.FormValue("service")
+		if service == "" {
+			http.Error(w, "service is required", http.StatusBadRequest)
+			return
+		}
+		PurgeCache(ServiceName(service), VersionString(req.FormValue("version")))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("/log/level", admin.authorizeChanges(serveLogLevel))
+	return mux
+}
+
+// authorizeChanges refuses requests other than GET and HEAD without the
+// admin token, or from a peer other than loopback when there is no token
+func (admin *adminServer) authorizeChanges(inner http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodGet || req.Method == http.MethodHead {
+			inner(w, req)
+			return
+		}
+
+		token := ""
+		if configured := admin.token.Load(); configured != nil {
+			token = *configured
+		}
+		if token == "" {
+			host, _, _ := net.SplitHostPort(req.RemoteAddr)
+			if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+				http.Error(w, "forbidden, set admin.token to allow changes from other hosts", http.StatusForbidden)
+				return
+			}
+		} else {
+			value, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(value), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		inner(w, req)
+	}
+}
+
+// serveLogLevel answers the log level, or sets it from a PUT body such as
+// debug. The level lasts until a config sets another
+func serveLogLevel(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		body, err := io.ReadAll(io.LimitReader(req.Body, 64))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		level := strings.TrimSpace(string(body))
+		if level == "" {
+			http.Error(w, "level is required", http.StatusBadRequest)
+			return
+		}
+		err = SetLogLevel(level)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger.Info("log level changed", "level", LogLevel())
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fmt.Fprintln(w, LogLevel())
+}
+
+// reconcile moves the admin endpoint to the configured address, or stops it
+func (admin *adminServer) reconcile(cfg *AdminConfig) {
+	address, token := "", ""
+	if cfg != nil {
+		address, token = cfg.Address, cfg.Token
+	}
+	admin.token.Store(&token)
+	if address == admin.address {
+		return
+	}
+
+	if admin.server != nil {
+		logger.Info("closing admin endpoint", "address", admin.address)
+		admin.server.Close()
+		admin.server = nil
+	}
+	admin.address = address
+	if address == "" {
+		return
+	}
+
+	server := &http.Server{Addr: address, Handler: admin.handler()}
+	admin.server = server
+	logger.Info("serving admin endpoint", "address", address)
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			logger.Error("admin endpoint failed", "address", address, "err", err)
+		}
+	}()
+}
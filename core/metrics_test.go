@@ -0,0 +1,52 @@
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminAuthorizesChanges(t *testing.T) {
+	defer SetLogLevel(LogLevel())
+
+	for _, test := range []struct {
+		name          string
+		token         string
+		method        string
+		peer          string
+		authorization string
+		expected      int
+	}{
+		{"read without a token", "", "GET", "192.0.2.1:1234", "", http.StatusOK},
+		{"change from loopback without a token", "", "PUT", "127.0.0.1:1234", "", http.StatusOK},
+		{"change from ipv6 loopback without a token", "", "PUT", "[::1]:1234", "", http.StatusOK},
+		{"change from another host without a token", "", "PUT", "192.0.2.1:1234", "", http.StatusForbidden},
+		{"read with a token", "s3cret", "GET", "192.0.2.1:1234", "", http.StatusOK},
+		{"change with the token", "s3cret", "PUT", "192.0.2.1:1234", "Bearer s3cret", http.StatusOK},
+		{"change with another token", "s3cret", "PUT", "127.0.0.1:1234", "Bearer guess", http.StatusUnauthorized},
+		{"change without the token", "s3cret", "PUT", "127.0.0.1:1234", "", http.StatusUnauthorized},
+	} {
+		admin := &adminServer{}
+		admin.token.Store(&test.token)
+		req := httptest.NewRequest(test.method, "/log/level", strings.NewReader("info"))
+		req.RemoteAddr = test.peer
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		recorder := httptest.NewRecorder()
+		admin.handler().ServeHTTP(recorder, req)
+		if recorder.Code != test.expected {
+			t.Errorf("%s: answered %d, expected %d", test.name, recorder.Code, test.expected)
+		}
+	}
+
+	admin := &adminServer{}
+	req := httptest.NewRequest("POST", "/cache/purge?service=echo", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	recorder := httptest.NewRecorder()
+	admin.handler().ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("purge from another host answered %d", recorder.Code)
+	}
+}
@@ -0,0 +1,107 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+)
+
+func proxyProtocolVersion(versionStr string) (byte, error) {
+	switch strings.ToLower(versionStr) {
+	case "":
+		return 0, nil
+	case "v1", "1":
+		return 1, nil
+	case "v2", "2":
+		return 2, nil
+	}
+	return 0, fmt.Errorf("unknown proxy protocol version: %s", versionStr)
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0)
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func containsAddr(networks []*net.IPNet, addr net.Addr) bool {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	default:
+		return false
+	}
+
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// newProxyProtocolListener accepts PROXY protocol headers from trusted
+// sources only; everyone else is served as plain HTTP
+func newProxyProtocolListener(listener net.Listener, state *proxyState) net.Listener {
+	return &proxyproto.Listener{
+		Listener: listener,
+		Policy: func(upstream net.Addr) (proxyproto.Policy, error) {
+			if containsAddr(state.config().trustedProxies, upstream) {
+				return proxyproto.USE, nil
+			}
+			return proxyproto.SKIP, nil
+		},
+	}
+}
+
+// newProxyProtocolTransport builds a single use transport which announces the
+// client of req to the upstream. Connections are never pooled, as the header
+// binds a connection to one client.
+func newProxyProtocolTransport(req *http.Request, version byte) *http.Transport {
+	var source, destination net.Addr
+	if addr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr); err == nil {
+		source = addr
+	}
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		destination = addr
+	}
+	header := proxyproto.HeaderProxyFromAddrs(version, source, destination)
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	return &http.Transport{
+		DisableKeepAlives: true,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			_, err = header.WriteTo(conn)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		},
+	}
+}
@@ -0,0 +1,405 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/redis.v5"
+)
+
+const (
+	defaultRateLimitPeriod = time.Second
+	rateLimitSweepInterval = time.Minute
+)
+
+// RateLimitConfig - token bucket limits on proxied requests. Store is memory,
+// limiting each proxy on its own, or redis, sharing the buckets of every proxy
+// reading config from the same redis
+type RateLimitConfig struct {
+	Store string          `json:"store,omitempty" yaml:"store,omitempty"`
+	Rules []RateLimitRule `json:"rules" yaml:"rules"`
+}
+
+// RateLimitRule - allows Requests per Period (1s by default), in bursts of up
+// to Burst (Requests by default), to each client of the requests routed to
+// Service, Version and Topology, any when empty. Clients are told apart by
+// Key, which is ip (the default), header:<name>, query:<name> or global for
+// one bucket shared by all, eg header:X-Api-Key for api keys. Requests without
+// the header or query parameter are told apart by ip. Name identifies the
+// buckets, and defaults to the index of the rule
+type RateLimitRule struct {
+	Name     string        `json:"name,omitempty" yaml:"name,omitempty"`
+	Service  ServiceName   `json:"service,omitempty" yaml:"service,omitempty"`
+	Version  VersionString `json:"version,omitempty" yaml:"version,omitempty"`
+	Topology TopologyKey   `json:"topology,omitempty" yaml:"topology,omitempty"`
+	Key      string        `json:"key,omitempty" yaml:"key,omitempty"`
+	Requests int64         `json:"requests" yaml:"requests"`
+	Period   string        `json:"period,omitempty" yaml:"period,omitempty"`
+	Burst    int64         `json:"burst,omitempty" yaml:"burst,omitempty"`
+}
+
+type rateLimitRule struct {
+	name        string
+	service     ServiceName
+	version     VersionString
+	topology    TopologyKey
+	key         func(req *http.Request, route *route) string
+	capacity    float64
+	rate        float64
+	period      time.Duration
+	distributed bool
+}
+
+// rateLimitBucket - the bucket of a rule a request is counted against
+type rateLimitBucket struct {
+	rule *rateLimitRule
+	key  string
+}
+
+// rateLimitStatus - the most constrained bucket a request was counted against
+type rateLimitStatus struct {
+	allowed bool
+	rule    *rateLimitRule
+	tokens  float64
+}
+
+// rateLimiter - the buckets of every rule, kept across config changes
+type rateLimiter struct {
+	local *localRateLimitStore
+	redis atomic.Pointer[redis.Client]
+}
+
+var limiter = &rateLimiter{local: newLocalRateLimitStore()}
+
+// UseRedis - the client rate limits with the redis store are shared through
+func UseRedis(client *redis.Client) {
+	limiter.redis.Store(client)
+}
+
+func mapRateLimitConfig(cfg *RateLimitConfig) ([]*rateLimitRule, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	distributed := false
+	switch cfg.Store {
+	case "", "memory":
+	case "redis":
+		distributed = true
+		if limiter.redis.Load() == nil {
+			logger.Warn("rate_limit store is redis, but byway is not reading config from redis, limiting each proxy locally")
+		}
+	default:
+		return nil, fmt.Errorf("unknown store %s", cfg.Store)
+	}
+
+	rules := make([]*rateLimitRule, 0, len(cfg.Rules))
+	names := make(map[string]bool)
+	for i, ruleConfig := range cfg.Rules {
+		rule, err := mapRateLimitRule(ruleConfig, i)
+		if err != nil {
+			return nil, fmt.Errorf("rules[%d]: %s", i, err)
+		}
+		if names[rule.name] {
+			return nil, fmt.Errorf("rules[%d]: duplicate name %s", i, rule.name)
+		}
+		names[rule.name] = true
+		rule.distributed = distributed
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func mapRateLimitRule(cfg RateLimitRule, index int) (*rateLimitRule, error) {
+	if cfg.Requests <= 0 {
+		return nil, fmt.Errorf("requests must be positive")
+	}
+	if cfg.Burst < 0 {
+		return nil, fmt.Errorf("burst must not be negative")
+	}
+	period := defaultRateLimitPeriod
+	if cfg.Period != "" {
+		var err error
+		period, err = time.ParseDuration(cfg.Period)
+		if err != nil {
+			return nil, fmt.Errorf("period: %s", err)
+		}
+		if period <= 0 {
+			return nil, fmt.Errorf("period must be positive")
+		}
+	}
+	key, err := rateLimitKey(cfg.Key)
+	if err != nil {
+		return nil, fmt.Errorf("key: %s", err)
+	}
+
+	rule := &rateLimitRule{
+		name:     cfg.Name,
+		service:  cfg.Service,
+		version:  cfg.Version,
+		topology: cfg.Topology,
+		key:      key,
+		capacity: float64(cfg.Requests),
+		rate:     float64(cfg.Requests) / period.Seconds(),
+		period:   period,
+	}
+	if rule.name == "" {
+		rule.name = strconv.Itoa(index)
+	}
+	if cfg.Burst > 0 {
+		rule.capacity = float64(cfg.Burst)
+	}
+	return rule, nil
+}
+
+// rateLimitKey - the func telling clients apart for key. Values are hashed,
+// so api keys are never stored
+func rateLimitKey(key string) (func(req *http.Request, route *route) string, error) {
+	kind, name, _ := strings.Cut(key, ":")
+	var value func(req *http.Request) string
+	switch kind {
+	case "", "ip":
+		return func(req *http.Request, route *route) string { return hashRateLimitKey("ip", route.clientIP) }, nil
+	case "global":
+		return func(req *http.Request, route *route) string { return "global" }, nil
+	case "header":
+		value = func(req *http.Request) string { return req.Header.Get(name) }
+	case "query":
+		value = func(req *http.Request) string { return req.URL.Query().Get(name) }
+	default:
+		return nil, fmt.Errorf("unknown key %s", key)
+	}
+	if name == "" {
+		return nil, fmt.Errorf("%s name is required", kind)
+	}
+	return func(req *http.Request, route *route) string {
+		if value := value(req); value != "" {
+			return hashRateLimitKey(kind, value)
+		}
+		return hashRateLimitKey("ip", route.clientIP)
+	}, nil
+}
+
+func hashRateLimitKey(kind string, value string) string {
+	sum := sha256.Sum256([]byte(kind + ":" + value))
+	return hex.EncodeToString(sum[:16])
+}
+
+// matchRateLimits - the buckets req, routed to the binding of route, is counted against
+func (config *config) matchRateLimits(req *http.Request, route *route) []rateLimitBucket {
+	var buckets []rateLimitBucket
+	for _, rule := range config.rateLimits {
+		if rule.service != "" && rule.service != route.binding.service {
+			continue
+		}
+		if rule.version != "" && rule.version != route.binding.version {
+			continue
+		}
+		if rule.topology != "" && rule.topology != route.topology {
+			continue
+		}
+		buckets = append(buckets, rateLimitBucket{rule, rule.key(req, route)})
+	}
+	return buckets
+}
+
+// take counts a request against each bucket in turn, stopping at the first
+// which is empty. The tokens taken from earlier buckets are then returned, so
+// refused requests count against no limit
+func (l *rateLimiter) take(buckets []rateLimitBucket) *rateLimitStatus {
+	var status *rateLimitStatus
+	now := time.Now()
+	client := l.redis.Load()
+	for i, bucket := range buckets {
+		key := bucket.storeKey()
+		allowed, tokens := false, 0.0
+		if bucket.rule.distributed && client != nil {
+			var err error
+			allowed, tokens, err = takeRedisToken(client, key, bucket.rule, now)
+			if err != nil {
+				logger.Warn("could not take shared rate limit token, limiting locally", "rule", bucket.rule.name, "err", err)
+				allowed, tokens = l.local.take(key, bucket.rule, now)
+			}
+		} else {
+			allowed, tokens = l.local.take(key, bucket.rule, now)
+		}
+
+		if status == nil || !allowed || tokens/bucket.rule.capacity < status.tokens/status.rule.capacity {
+			status = &rateLimitStatus{allowed: allowed, rule: bucket.rule, tokens: tokens}
+		}
+		if !allowed {
+			metrics.rateLimited.WithLabelValues(bucket.rule.name).Inc()
+			l.refund(client, buckets[:i])
+			break
+		}
+	}
+	return status
+}
+
+func (bucket rateLimitBucket) storeKey() string {
+	return "byway.ratelimit." + bucket.rule.name + "/" + bucket.key
+}
+
+// refund returns a token to each of buckets
+func (l *rateLimiter) refund(client *redis.Client, buckets []rateLimitBucket) {
+	for _, bucket := range buckets {
+		key := bucket.storeKey()
+		if bucket.rule.distributed && client != nil {
+			err := client.Eval(refundTokenScript, []string{key}, bucket.rule.capacity).Err()
+			if err == nil {
+				continue
+			}
+			logger.Warn("could not refund shared rate limit token", "rule", bucket.rule.name, "err", err)
+		}
+		l.local.refund(key, bucket.rule)
+	}
+}
+
+// setHeaders describes the bucket with the RateLimit headers of
+// draft-ietf-httpapi-ratelimit-headers
+func (status *rateLimitStatus) setHeaders(header http.Header) {
+	rule := status.rule
+	header.Set("RateLimit-Limit", strconv.FormatInt(int64(rule.capacity), 10))
+	header.Set("RateLimit-Remaining", strconv.FormatInt(int64(math.Floor(status.tokens)), 10))
+	header.Set("RateLimit-Reset", strconv.FormatInt(int64(math.Ceil((rule.capacity-status.tokens)/rule.rate)), 10))
+	header.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", int64(rule.capacity), int64(math.Ceil(rule.period.Seconds()))))
+}
+
+// tooManyRequests - the response to a request over its limit
+func (status *rateLimitStatus) tooManyRequests(req *http.Request) *http.Response {
+	body := "too many requests\n"
+	resp := &http.Response{
+		Status:        "429 Too Many Requests",
+		StatusCode:    http.StatusTooManyRequests,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		ContentLength: int64(len(body)),
+		Body:          http.NoBody,
+		Request:       req,
+	}
+	if req.Method != http.MethodHead {
+		resp.Body = io.NopCloser(strings.NewReader(body))
+	}
+	retryAfter := int64(math.Ceil((1 - status.tokens) / status.rule.rate))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	resp.Header.Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	status.setHeaders(resp.Header)
+	return resp
+}
+
+// localRateLimitStore - buckets of this proxy alone
+type localRateLimitStore struct {
+	lock    sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newLocalRateLimitStore() *localRateLimitStore {
+	return &localRateLimitStore{buckets: make(map[string]*tokenBucket), swept: time.Now()}
+}
+
+func (s *localRateLimitStore) take(key string, rule *rateLimitRule, now time.Time) (bool, float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if now.Sub(s.swept) > rateLimitSweepInterval {
+		s.sweep(now)
+	}
+
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: rule.capacity, updated: now}
+		s.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(rule.capacity, bucket.tokens+now.Sub(bucket.updated).Seconds()*rule.rate)
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		return false, bucket.tokens
+	}
+	bucket.tokens--
+	return true, bucket.tokens
+}
+
+func (s *localRateLimitStore) refund(key string, rule *rateLimitRule) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if bucket, ok := s.buckets[key]; ok {
+		bucket.tokens = math.Min(rule.capacity, bucket.tokens+1)
+	}
+}
+
+// sweep forgets buckets which have not been used for a sweep interval, any
+// of them would have refilled since
+func (s *localRateLimitStore) sweep(now time.Time) {
+	for key, bucket := range s.buckets {
+		if now.Sub(bucket.updated) > rateLimitSweepInterval {
+			delete(s.buckets, key)
+		}
+	}
+	s.swept = now
+}
+
+// takeTokenScript - the token bucket of localRateLimitStore.take, in one
+// round trip. Buckets expire once they would have refilled
+const takeTokenScript = `
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(bucket[1]) or capacity
+local updated = tonumber(bucket[2]) or now
+tokens = math.min(capacity, tokens + math.max(0, now - updated) * rate)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'updated', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil(capacity / rate) + 1000)
+return {allowed, tostring(tokens)}
+`
+
+// refundTokenScript - returns a token to a bucket which still exists
+const refundTokenScript = `
+local tokens = tonumber(redis.call('HGET', KEYS[1], 'tokens'))
+if tokens then
+	redis.call('HSET', KEYS[1], 'tokens', tostring(math.min(tonumber(ARGV[1]), tokens + 1)))
+end
+return 1
+`
+
+func takeRedisToken(client *redis.Client, key string, rule *rateLimitRule, now time.Time) (bool, float64, error) {
+	result, err := client.Eval(takeTokenScript, []string{key},
+		rule.capacity, rule.rate/1000, now.UnixNano()/int64(time.Millisecond)).Result()
+	if err != nil {
+		return false, 0, err
+	}
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 2 {
+		return false, 0, fmt.Errorf("unexpected reply %v", result)
+	}
+	allowed, _ := values[0].(int64)
+	encoded, _ := values[1].(string)
+	tokens, err := strconv.ParseFloat(encoded, 64)
+	if err != nil {
+		return false, 0, fmt.Errorf("unexpected reply %v", result)
+	}
+	return allowed == 1, tokens, nil
+}
@@ -0,0 +1,209 @@
+package core
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func mustMapRateLimitRule(t *testing.T, cfg RateLimitRule) *rateLimitRule {
+	t.Helper()
+	rule, err := mapRateLimitRule(cfg, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rule
+}
+
+func TestLocalRateLimitStoreRefills(t *testing.T) {
+	store := newLocalRateLimitStore()
+	rule := mustMapRateLimitRule(t, RateLimitRule{Requests: 2, Period: "1s"})
+	now := time.Now()
+
+	for i, expected := range []bool{true, true, false} {
+		if allowed, _ := store.take("client", rule, now); allowed != expected {
+			t.Errorf("take %d allowed: %v", i, allowed)
+		}
+	}
+	if allowed, tokens := store.take("client", rule, now.Add(250*time.Millisecond)); allowed || tokens != 0.5 {
+		t.Errorf("a quarter period later allowed: %v with %v tokens", allowed, tokens)
+	}
+	if allowed, tokens := store.take("client", rule, now.Add(500*time.Millisecond)); !allowed || tokens != 0 {
+		t.Errorf("half a period later allowed: %v with %v tokens", allowed, tokens)
+	}
+	if allowed, tokens := store.take("client", rule, now.Add(time.Hour)); !allowed || tokens != 1 {
+		t.Errorf("refilled bucket allowed: %v with %v tokens, expected no more than capacity", allowed, tokens)
+	}
+	if allowed, _ := store.take("other", rule, now); !allowed {
+		t.Error("buckets of other keys were shared")
+	}
+}
+
+func TestLocalRateLimitStoreBurst(t *testing.T) {
+	store := newLocalRateLimitStore()
+	rule := mustMapRateLimitRule(t, RateLimitRule{Requests: 1, Period: "1s", Burst: 5})
+	now := time.Now()
+
+	for i := 0; i < 5; i++ {
+		if allowed, _ := store.take("client", rule, now); !allowed {
+			t.Fatalf("request %d of the burst refused", i)
+		}
+	}
+	if allowed, _ := store.take("client", rule, now); allowed {
+		t.Error("request beyond the burst allowed")
+	}
+	if allowed, _ := store.take("client", rule, now.Add(time.Second)); !allowed {
+		t.Error("request a period after the burst refused")
+	}
+}
+
+func TestLocalRateLimitStoreSweeps(t *testing.T) {
+	store := newLocalRateLimitStore()
+	rule := mustMapRateLimitRule(t, RateLimitRule{Requests: 1})
+	now := time.Now()
+
+	store.take("idle", rule, now)
+	store.take("busy", rule, now.Add(rateLimitSweepInterval*9/10))
+	store.take("other", rule, now.Add(rateLimitSweepInterval*3/2))
+	if _, ok := store.buckets["idle"]; ok {
+		t.Error("idle bucket was not swept")
+	}
+	if _, ok := store.buckets["busy"]; !ok {
+		t.Error("busy bucket was swept")
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	client := &route{clientIP: "192.0.2.1"}
+	withKey := httptest.NewRequest("GET", "http://echo.example.com/?key=abc", nil)
+	withKey.Header.Set("X-Api-Key", "abc")
+	without := httptest.NewRequest("GET", "http://echo.example.com/", nil)
+
+	ip, err := rateLimitKey("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipKey := ip(without, client)
+	if ipKey != hashRateLimitKey("ip", "192.0.2.1") {
+		t.Errorf("ip key was %s", ipKey)
+	}
+
+	for _, key := range []string{"header:X-Api-Key", "query:key"} {
+		keyFunc, err := rateLimitKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value := keyFunc(withKey, client); value == ipKey || value == "abc" {
+			t.Errorf("%s: key was %s, expected the hashed value", key, value)
+		}
+		if value := keyFunc(without, client); value != ipKey {
+			t.Errorf("%s: key without a value was %s, expected the ip", key, value)
+		}
+	}
+
+	global, err := rateLimitKey("global")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if global(withKey, client) != global(without, &route{clientIP: "192.0.2.2"}) {
+		t.Error("global keys differ between clients")
+	}
+
+	for _, key := range []string{"cookie:session", "header", "header:", "query:"} {
+		if _, err := rateLimitKey(key); err == nil {
+			t.Errorf("%s: expected an error", key)
+		}
+	}
+}
+
+func TestMatchRateLimits(t *testing.T) {
+	rules, err := mapRateLimitConfig(&RateLimitConfig{Rules: []RateLimitRule{
+		{Name: "all", Requests: 1},
+		{Name: "echo", Service: "echo", Requests: 1},
+		{Name: "echo-1", Service: "echo", Version: "1.0.0", Requests: 1},
+		{Name: "dev", Topology: "dev", Requests: 1},
+		{Name: "search", Service: "search", Requests: 1},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &config{rateLimits: rules}
+	req := httptest.NewRequest("GET", "http://echo.example.com/", nil)
+
+	for _, test := range []struct {
+		binding  binding
+		topology TopologyKey
+		expected []string
+	}{
+		{binding{service: "echo", version: "1.0.0"}, "", []string{"all", "echo", "echo-1"}},
+		{binding{service: "echo", version: "1.0.1"}, "dev", []string{"all", "echo", "dev"}},
+		{binding{service: "other", version: "1.0.0"}, "", []string{"all"}},
+	} {
+		buckets := config.matchRateLimits(req, &route{binding: &test.binding, topology: test.topology})
+		names := make([]string, 0)
+		for _, bucket := range buckets {
+			names = append(names, bucket.rule.name)
+		}
+		if len(names) != len(test.expected) {
+			t.Errorf("%s %s %s matched %v, expected %v", test.binding.service, test.binding.version, test.topology, names, test.expected)
+			continue
+		}
+		for i := range names {
+			if names[i] != test.expected[i] {
+				t.Errorf("%s %s %s matched %v, expected %v", test.binding.service, test.binding.version, test.topology, names, test.expected)
+				break
+			}
+		}
+	}
+}
+
+func TestRateLimiterRefundsEarlierBuckets(t *testing.T) {
+	limiter := &rateLimiter{local: newLocalRateLimitStore()}
+	broad := mustMapRateLimitRule(t, RateLimitRule{Name: "broad", Requests: 10, Period: "1h"})
+	narrow := mustMapRateLimitRule(t, RateLimitRule{Name: "narrow", Requests: 1, Period: "1h"})
+	buckets := []rateLimitBucket{{broad, "global"}, {narrow, "client"}}
+
+	if status := limiter.take(buckets); !status.allowed || status.rule != narrow {
+		t.Fatalf("first request allowed: %v by %s", status.allowed, status.rule.name)
+	}
+	for i := 0; i < 3; i++ {
+		if status := limiter.take(buckets); status.allowed || status.rule != narrow {
+			t.Fatalf("request over the narrow limit allowed: %v by %s", status.allowed, status.rule.name)
+		}
+	}
+	if tokens := limiter.local.buckets[rateLimitBucket{broad, "global"}.storeKey()].tokens; tokens < 9 || tokens > 9.01 {
+		t.Errorf("broad bucket has %v tokens, expected refused requests to be refunded", tokens)
+	}
+}
+
+func TestTooManyRequests(t *testing.T) {
+	rule := mustMapRateLimitRule(t, RateLimitRule{Requests: 10, Period: "5s"})
+	status := &rateLimitStatus{rule: rule, tokens: 0.5}
+
+	req := httptest.NewRequest("GET", "http://echo.example.com/", nil)
+	resp := status.tooManyRequests(req)
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusTooManyRequests || string(body) != "too many requests\n" {
+		t.Errorf("answered %d %q", resp.StatusCode, body)
+	}
+	for name, expected := range map[string]string{
+		"Retry-After":         "1",
+		"RateLimit-Limit":     "10",
+		"RateLimit-Remaining": "0",
+		"RateLimit-Reset":     "5",
+		"RateLimit-Policy":    "10;w=5",
+	} {
+		if value := resp.Header.Get(name); value != expected {
+			t.Errorf("%s was %q, expected %q", name, value, expected)
+		}
+	}
+
+	slow := mustMapRateLimitRule(t, RateLimitRule{Requests: 1, Period: "1m"})
+	resp = (&rateLimitStatus{rule: slow}).tooManyRequests(httptest.NewRequest("HEAD", "http://echo.example.com/", nil))
+	body, _ = io.ReadAll(resp.Body)
+	if resp.Header.Get("Retry-After") != "60" || len(body) != 0 {
+		t.Errorf("HEAD answered %q after Retry-After %s", body, resp.Header.Get("Retry-After"))
+	}
+}
@@ -0,0 +1,79 @@
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const defaultRedirectStatus = http.StatusFound
+
+// RedirectRuleConfig  config of a redirect sent back to the client. Match is a
+// regex over //<host>/<path> of the request, Target its replacement, which
+// may refer to capture groups as $1. The query is dropped unless preserved
+type RedirectRuleConfig struct {
+	Match         string `json:"match" yaml:"match"`
+	Target        string `json:"target" yaml:"target"`
+	Status        int    `json:"status,omitempty" yaml:"status,omitempty"`
+	PreserveQuery bool   `json:"preserve_query,omitempty" yaml:"preserve_query,omitempty"`
+}
+
+type redirectRule struct {
+	pattern       *regexp.Regexp
+	target        string
+	status        int
+	preserveQuery bool
+}
+
+func mapRedirectRuleConfig(ruleConfig RedirectRuleConfig) (redirectRule, error) {
+	status := ruleConfig.Status
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	case 0:
+		status = defaultRedirectStatus
+	default:
+		return redirectRule{}, fmt.Errorf("unsupported status: %d", status)
+	}
+
+	pattern, err := regexp.Compile(ruleConfig.Match)
+	if err != nil {
+		return redirectRule{}, fmt.Errorf("match: %s", err)
+	}
+
+	return redirectRule{
+		pattern:       pattern,
+		target:        ruleConfig.Target,
+		status:        status,
+		preserveQuery: ruleConfig.PreserveQuery,
+	}, nil
+}
+
+// redirect answers req with the first matching redirect rule, reporting
+// whether it did
+func redirect(config *config, w http.ResponseWriter, req *http.Request) bool {
+	if len(config.redirects) == 0 {
+		return false
+	}
+
+	input := "//" + req.Host + req.URL.EscapedPath()
+	for _, rule := range config.redirects {
+		if !rule.pattern.MatchString(input) {
+			continue
+		}
+
+		location := rule.pattern.ReplaceAllString(input, rule.target)
+		if rule.preserveQuery && req.URL.RawQuery != "" {
+			separator := "?"
+			if strings.Contains(location, "?") {
+				separator = "&"
+			}
+			location += separator + req.URL.RawQuery
+		}
+
+		logger.DebugContext(req.Context(), "redirect", "from", input, "to", location, "status", rule.status)
+		http.Redirect(w, req, location, rule.status)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package core
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+)
+
+const (
+	defaultRequestIDHeader = "X-Request-Id"
+	maxRequestIDLength     = 200
+)
+
+// RequestIDConfig - the header carrying request ids. Ids sent by clients are
+// kept, requests without one are given a new id
+type RequestIDConfig struct {
+	Header string `json:"header,omitempty" yaml:"header,omitempty"`
+}
+
+func mapRequestIDConfig(cfg *RequestIDConfig) string {
+	if cfg == nil || cfg.Header == "" {
+		return defaultRequestIDHeader
+	}
+	return http.CanonicalHeaderKey(cfg.Header)
+}
+
+// newRequestID - a random (version 4) uuid
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// validRequestID accepts ids which are safe to copy into logs and headers
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// withRequestID gives every request an id, which is passed upstream, echoed
+// in the response and recorded on the route for logs
+func withRequestID(state *proxyState, inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		header := state.config().requestIDHeader
+		if header == "" {
+			header = defaultRequestIDHeader
+		}
+
+		id := req.Header.Get(header)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		req.Header.Set(header, id)
+		routeFromContext(req.Context()).requestID = id
+
+		inner.ServeHTTP(&requestIDWriter{ResponseWriter: w, header: header, id: id}, req)
+	})
+}
+
+// requestIDWriter - sets the request id on the response as its header is
+// written, replacing any id the upstream answered with
+type requestIDWriter struct {
+	http.ResponseWriter
+	header      string
+	id          string
+	wroteHeader bool
+}
+
+func (w *requestIDWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.Header().Set(w.header, w.id)
+		if status >= http.StatusOK {
+			w.wroteHeader = true
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *requestIDWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the flusher and hijacker beneath
+func (w *requestIDWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// writeError answers req with status, naming the request id so that the
+// failure can be found in the logs
+func writeError(w http.ResponseWriter, req *http.Request, status int) {
+	message := http.StatusText(status)
+	if id := routeFromContext(req.Context()).requestID; id != "" {
+		message = fmt.Sprintf("%s\nrequest id: %s", message, id)
+	}
+	http.Error(w, message, status)
+}
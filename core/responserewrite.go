@@ -0,0 +1,378 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const defaultBodyRewriteMaxSize = 1 << 20
+
+var defaultBodyRewriteContentTypes = []string{"text/html", "application/json"}
+
+// ResponseRewriteConfig - maps responses which refer to the upstream back to
+// the public host of the binding. Location covers Location and
+// Content-Location, Cookies the Domain and Path of Set-Cookie. PublicHost is
+// a header template, {host} by default, eg {version_host}.echo.example.com.
+// PathPrefixes maps upstream path prefixes to public ones
+type ResponseRewriteConfig struct {
+	Location     bool               `json:"location,omitempty" yaml:"location,omitempty"`
+	Cookies      bool               `json:"cookies,omitempty" yaml:"cookies,omitempty"`
+	PublicHost   string             `json:"public_host,omitempty" yaml:"public_host,omitempty"`
+	PathPrefixes map[string]string  `json:"path_prefixes,omitempty" yaml:"path_prefixes,omitempty"`
+	Body         *BodyRewriteConfig `json:"body,omitempty" yaml:"body,omitempty"`
+}
+
+// BodyRewriteConfig - replaces the upstream origin with the public one, and
+// each key of Replace with its value, while streaming bodies of ContentTypes
+// (html and json by default). Only the first MaxSize bytes (1MiB by default)
+// are rewritten, larger responses with a known length are not rewritten at all
+type BodyRewriteConfig struct {
+	ContentTypes []string          `json:"content_types,omitempty" yaml:"content_types,omitempty"`
+	MaxSize      int64             `json:"max_size,omitempty" yaml:"max_size,omitempty"`
+	Replace      map[string]string `json:"replace,omitempty" yaml:"replace,omitempty"`
+}
+
+type pathPrefix struct {
+	upstream string
+	public   string
+}
+
+type responseRewrite struct {
+	location     bool
+	cookies      bool
+	publicHost   headerTemplate
+	pathPrefixes []pathPrefix
+	body         *bodyRewrite
+}
+
+type bodyRewrite struct {
+	contentTypes []string
+	maxSize      int64
+	replace      []replacement
+}
+
+type replacement struct {
+	from []byte
+	to   []byte
+}
+
+func mapResponseRewriteConfig(cfg *ResponseRewriteConfig, secrets *secretStore) (*responseRewrite, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	publicHost := cfg.PublicHost
+	if publicHost == "" {
+		publicHost = "{host}"
+	}
+	template, err := compileHeaderTemplate(publicHost, secrets)
+	if err != nil {
+		return nil, fmt.Errorf("public_host: %s", err)
+	}
+	rewrite := &responseRewrite{
+		location:   cfg.Location,
+		cookies:    cfg.Cookies,
+		publicHost: template,
+	}
+
+	for upstream, public := range cfg.PathPrefixes {
+		if !strings.HasPrefix(upstream, "/") || !strings.HasPrefix(public, "/") {
+			return nil, fmt.Errorf("path_prefixes: %s: prefixes must start with /", upstream)
+		}
+		rewrite.pathPrefixes = append(rewrite.pathPrefixes, pathPrefix{upstream, public})
+	}
+	sort.Slice(rewrite.pathPrefixes, func(i, j int) bool {
+		return len(rewrite.pathPrefixes[i].upstream) > len(rewrite.pathPrefixes[j].upstream)
+	})
+
+	if cfg.Body != nil {
+		if cfg.Body.MaxSize < 0 {
+			return nil, fmt.Errorf("body.max_size must not be negative")
+		}
+		body := &bodyRewrite{
+			contentTypes: cfg.Body.ContentTypes,
+			maxSize:      cfg.Body.MaxSize,
+		}
+		if len(body.contentTypes) == 0 {
+			body.contentTypes = defaultBodyRewriteContentTypes
+		}
+		if body.maxSize == 0 {
+			body.maxSize = defaultBodyRewriteMaxSize
+		}
+		for from, to := range cfg.Body.Replace {
+			if from == "" {
+				return nil, fmt.Errorf("body.replace: empty string can not be replaced")
+			}
+			body.replace = append(body.replace, replacement{[]byte(from), []byte(to)})
+		}
+		rewrite.body = body
+	}
+	return rewrite, nil
+}
+
+// apply rewrites resp, which was answered by the upstream of binding
+func (rewrite *responseRewrite) apply(resp *http.Response, binding *binding, values headerValues) {
+	if rewrite == nil {
+		return
+	}
+
+	upstreamHosts := []string{binding.host}
+	if resp.Request.Host != "" && !strings.EqualFold(resp.Request.Host, binding.host) {
+		upstreamHosts = append(upstreamHosts, resp.Request.Host)
+	}
+	publicScheme := publicScheme(resp.Request)
+	publicHost := rewrite.publicHost.render(values)
+
+	if rewrite.location {
+		for _, name := range []string{"Location", "Content-Location"} {
+			if value := resp.Header.Get(name); value != "" {
+				resp.Header.Set(name, rewrite.rewriteLocation(value, upstreamHosts, publicScheme, publicHost))
+			}
+		}
+	}
+
+	if rewrite.cookies {
+		cookies := resp.Header.Values("Set-Cookie")
+		for i, cookie := range cookies {
+			cookies[i] = rewrite.rewriteCookie(cookie, upstreamHosts, publicHost)
+		}
+	}
+
+	if rewrite.body != nil && rewrite.body.applies(resp) {
+		replace := make([]replacement, 0, len(rewrite.body.replace)+3*len(upstreamHosts))
+		for _, host := range upstreamHosts {
+			replace = append(replace,
+				replacement{[]byte(binding.scheme + "://" + host), []byte(publicScheme + "://" + publicHost)},
+				replacement{[]byte(binding.scheme + `:\/\/` + host), []byte(publicScheme + `:\/\/` + publicHost)},
+				replacement{[]byte("//" + host), []byte("//" + publicHost)},
+			)
+		}
+		replace = append(replace, rewrite.body.replace...)
+
+		resp.Body = newReplacingReader(resp.Body, replace, rewrite.body.maxSize)
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+	}
+}
+
+// publicScheme - the scheme the client used, as byway or a trusted proxy forwarded it
+func publicScheme(req *http.Request) string {
+	proto, _, _ := strings.Cut(req.Header.Get("X-Forwarded-Proto"), ",")
+	proto = strings.TrimSpace(proto)
+	if proto == "http" || proto == "https" {
+		return proto
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+func (rewrite *responseRewrite) mapPath(path string) string {
+	for _, prefix := range rewrite.pathPrefixes {
+		if !strings.HasPrefix(path, prefix.upstream) {
+			continue
+		}
+		rest := path[len(prefix.upstream):]
+		if rest != "" && rest[0] != '/' && !strings.HasSuffix(prefix.upstream, "/") {
+			continue
+		}
+		mapped := prefix.public + rest
+		if strings.HasSuffix(prefix.public, "/") && strings.HasPrefix(rest, "/") {
+			mapped = prefix.public + rest[1:]
+		}
+		return mapped
+	}
+	return path
+}
+
+func (rewrite *responseRewrite) rewriteLocation(location string, upstreamHosts []string, publicScheme string, publicHost string) string {
+	parsed, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+	if parsed.Host != "" {
+		if !containsHost(upstreamHosts, parsed.Host) {
+			return location
+		}
+		if parsed.Scheme != "" {
+			parsed.Scheme = publicScheme
+		}
+		parsed.Host = publicHost
+	} else if !strings.HasPrefix(parsed.Path, "/") {
+		return location
+	}
+
+	path := rewrite.mapPath(parsed.Path)
+	if path != parsed.Path {
+		parsed.Path = path
+		parsed.RawPath = ""
+	}
+	return parsed.String()
+}
+
+func (rewrite *responseRewrite) rewriteCookie(cookie string, upstreamHosts []string, publicHost string) string {
+	attributes := strings.Split(cookie, ";")
+	for i, attribute := range attributes[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(attribute), "=")
+		switch strings.ToLower(name) {
+		case "domain":
+			domain := strings.TrimPrefix(value, ".")
+			for _, host := range upstreamHosts {
+				if strings.EqualFold(domain, hostname(host)) {
+					attributes[i+1] = " " + name + "=" + hostname(publicHost)
+					break
+				}
+			}
+		case "path":
+			attributes[i+1] = " " + name + "=" + rewrite.mapPath(value)
+		}
+	}
+	return strings.Join(attributes, ";")
+}
+
+func containsHost(hosts []string, host string) bool {
+	for _, candidate := range hosts {
+		if strings.EqualFold(candidate, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostname - host without any port
+func hostname(host string) string {
+	name, _, err := net.SplitHostPort(host)
+	if err != nil {
+		return host
+	}
+	return name
+}
+
+// applies reports whether the body of resp may be rewritten
+func (body *bodyRewrite) applies(resp *http.Response) bool {
+	if resp.Body == nil || resp.Body == http.NoBody {
+		return false
+	}
+	if resp.ContentLength > body.maxSize {
+		return false
+	}
+	encoding := resp.Header.Get("Content-Encoding")
+	if encoding != "" && encoding != "identity" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, contentType := range body.contentTypes {
+		if strings.EqualFold(mediaType, contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+// replacingReader - replaces strings in the first limit bytes of source
+// while streaming it, holding back only enough to match across reads
+type replacingReader struct {
+	source    io.ReadCloser
+	replace   []replacement
+	keep      int
+	remaining int64
+	buffer    []byte
+	pending   []byte
+	output    []byte
+	err       error
+}
+
+func newReplacingReader(source io.ReadCloser, replace []replacement, limit int64) *replacingReader {
+	// at equal offsets the longest match wins
+	sort.SliceStable(replace, func(i, j int) bool { return len(replace[i].from) > len(replace[j].from) })
+	keep := 0
+	if len(replace) > 0 {
+		keep = len(replace[0].from) - 1
+	}
+	return &replacingReader{
+		source:    source,
+		replace:   replace,
+		keep:      keep,
+		remaining: limit,
+		buffer:    make([]byte, 32*1024),
+	}
+}
+
+func (r *replacingReader) Read(p []byte) (int, error) {
+	for len(r.output) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.remaining <= 0 {
+			return r.source.Read(p)
+		}
+
+		buffer := r.buffer
+		if int64(len(buffer)) > r.remaining {
+			buffer = buffer[:r.remaining]
+		}
+		n, err := r.source.Read(buffer)
+		r.remaining -= int64(n)
+		r.pending = append(r.pending, buffer[:n]...)
+		r.err = err
+		r.output = r.rewrite(err != nil || r.remaining <= 0)
+	}
+
+	n := copy(p, r.output)
+	r.output = r.output[n:]
+	return n, nil
+}
+
+// rewrite replaces every match in pending, holding back a tail which could
+// begin a match unless final
+func (r *replacingReader) rewrite(final bool) []byte {
+	var output []byte
+	data := r.pending
+	for {
+		index, match := r.next(data)
+		if index < 0 || !final && index+r.keep >= len(data) {
+			// a longer match may start at index once more data arrives
+			break
+		}
+		output = append(output, data[:index]...)
+		output = append(output, match.to...)
+		data = data[index+len(match.from):]
+	}
+
+	cut := len(data)
+	if !final {
+		cut = len(data) - r.keep
+		if cut < 0 {
+			cut = 0
+		}
+	}
+	output = append(output, data[:cut]...)
+	r.pending = append([]byte(nil), data[cut:]...)
+	return output
+}
+
+func (r *replacingReader) next(data []byte) (int, replacement) {
+	first, match := -1, replacement{}
+	for _, candidate := range r.replace {
+		index := bytes.Index(data, candidate.from)
+		if index >= 0 && (first < 0 || index < first) {
+			first, match = index, candidate
+		}
+	}
+	return first, match
+}
+
+func (r *replacingReader) Close() error {
+	return r.source.Close()
+}
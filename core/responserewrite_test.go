@@ -0,0 +1,192 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func mustMapResponseRewrite(t *testing.T, cfg *ResponseRewriteConfig) *responseRewrite {
+	t.Helper()
+	rewrite, err := mapResponseRewriteConfig(cfg, &secretStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rewrite
+}
+
+func TestResponseRewriteLocation(t *testing.T) {
+	rewrite := mustMapResponseRewrite(t, &ResponseRewriteConfig{
+		Location:     true,
+		PathPrefixes: map[string]string{"/app": "/echo", "/app/static/": "/assets/"},
+	})
+	upstream := []string{"localhost:8081", "internal.example.com"}
+
+	for location, expected := range map[string]string{
+		"http://localhost:8081/app/login?next=/":  "https://echo.example.com/echo/login?next=/",
+		"http://INTERNAL.example.com/app":         "https://echo.example.com/echo",
+		"//localhost:8081/other":                  "//echo.example.com/other",
+		"/app/static/site.css":                    "/assets/site.css",
+		"/application":                            "/application",
+		"https://elsewhere.example.com/app/login": "https://elsewhere.example.com/app/login",
+		"relative/path":                           "relative/path",
+	} {
+		if rewritten := rewrite.rewriteLocation(location, upstream, "https", "echo.example.com"); rewritten != expected {
+			t.Errorf("%s rewritten to %s, expected %s", location, rewritten, expected)
+		}
+	}
+}
+
+func TestResponseRewriteCookies(t *testing.T) {
+	rewrite := mustMapResponseRewrite(t, &ResponseRewriteConfig{
+		Cookies:      true,
+		PathPrefixes: map[string]string{"/app": "/echo"},
+	})
+	upstream := []string{"localhost:8081", "internal.example.com"}
+
+	for cookie, expected := range map[string]string{
+		"session=1; Domain=internal.example.com; Path=/app/; HttpOnly": "session=1; Domain=echo.example.com; Path=/echo/; HttpOnly",
+		"session=1; domain=.localhost; path=/app":                      "session=1; domain=echo.example.com; path=/echo",
+		"session=1; Domain=other.example.com; Path=/":                  "session=1; Domain=other.example.com; Path=/",
+		"session=1": "session=1",
+	} {
+		if rewritten := rewrite.rewriteCookie(cookie, upstream, "echo.example.com:8443"); rewritten != expected {
+			t.Errorf("%s rewritten to %s, expected %s", cookie, rewritten, expected)
+		}
+	}
+}
+
+// replaceAll - what replacingReader must produce, replace being ordered
+// longest first so the longest match wins at equal offsets
+func replaceAll(data []byte, replace []replacement) []byte {
+	var output []byte
+	for len(data) > 0 {
+		matched := false
+		for _, candidate := range replace {
+			if bytes.HasPrefix(data, candidate.from) {
+				output = append(output, candidate.to...)
+				data = data[len(candidate.from):]
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			output = append(output, data[0])
+			data = data[1:]
+		}
+	}
+	return output
+}
+
+func TestReplacingReaderAcrossReads(t *testing.T) {
+	replace := func() []replacement {
+		return []replacement{
+			{[]byte("//localhost:8081"), []byte("//echo.example.com")},
+			{[]byte("bc"), []byte("2")},
+			{[]byte("http://localhost:8081"), []byte("https://echo.example.com")},
+			{[]byte("abcd"), []byte("1")},
+			{[]byte("aaa"), []byte("b")},
+		}
+	}
+	input := []byte(`<a href="http://localhost:8081/x">//localhost:8081</a>aaaa abc abcd` +
+		strings.Repeat("-", 100) + `"http://localhost:8081"abcabcdhttp://localhost:808`)
+	ordered := replace()
+	sort.SliceStable(ordered, func(i, j int) bool { return len(ordered[i].from) > len(ordered[j].from) })
+	expected := replaceAll(input, ordered)
+
+	read := func(name string, source io.Reader) {
+		t.Helper()
+		output, err := io.ReadAll(iotest.OneByteReader(newReplacingReader(io.NopCloser(source), replace(), 1<<20)))
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if !bytes.Equal(output, expected) {
+			t.Fatalf("%s: read %q, expected %q", name, output, expected)
+		}
+	}
+
+	read("whole", bytes.NewReader(input))
+	read("one byte", iotest.OneByteReader(bytes.NewReader(input)))
+	read("half", iotest.HalfReader(bytes.NewReader(input)))
+	read("data err", iotest.DataErrReader(bytes.NewReader(input)))
+	for split := 1; split < len(input); split++ {
+		read(fmt.Sprintf("split at %d", split), io.MultiReader(bytes.NewReader(input[:split]), bytes.NewReader(input[split:])))
+	}
+}
+
+func TestReplacingReaderLimit(t *testing.T) {
+	input := []byte("aaaa|aaaa|aaaa")
+	reader := newReplacingReader(io.NopCloser(iotest.OneByteReader(bytes.NewReader(input))), []replacement{{[]byte("aa"), []byte("b")}}, 6)
+	output, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the first 6 bytes are rewritten, the rest passes through
+	if string(output) != "bb|aaaa|aaaa" {
+		t.Errorf("read %q", output)
+	}
+}
+
+func TestResponseRewriteOfBindings(t *testing.T) {
+	var upstreamHost string
+	handler := newProxyTest(t, EndpointConfig{
+		Headers: map[string]string{"host": "internal.example.com"},
+		ResponseRewrite: &ResponseRewriteConfig{
+			Location:   true,
+			Cookies:    true,
+			PublicHost: "{version_host}.echo.example.com",
+			Body:       &BodyRewriteConfig{Replace: map[string]string{"Internal": "Public"}},
+		},
+	}, func(w http.ResponseWriter, r *http.Request) {
+		upstreamHost = r.Host
+		w.Header().Set("Location", "http://internal.example.com/next")
+		w.Header().Add("Set-Cookie", "a=1; Domain=internal.example.com")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, `<a href="http://internal.example.com/next">Internal link</a>`+"\n ")
+	})
+
+	resp := serveProxyTest(handler, httptest.NewRequest("GET", "/", nil))
+	if upstreamHost != "internal.example.com" {
+		t.Fatalf("upstream was sent host %s", upstreamHost)
+	}
+	if location := resp.Header().Get("Location"); location != "http://1-0-0.echo.example.com/next" {
+		t.Errorf("Location was %s", location)
+	}
+	if cookie := resp.Header().Get("Set-Cookie"); cookie != "a=1; Domain=1-0-0.echo.example.com" {
+		t.Errorf("Set-Cookie was %s", cookie)
+	}
+	if body := resp.Body.String(); body != `<a href="http://1-0-0.echo.example.com/next">Public link</a>`+"\n " {
+		t.Errorf("body was %q", body)
+	}
+	if length := resp.Header().Get("Content-Length"); length != "" {
+		t.Errorf("Content-Length of the upstream body was kept: %s", length)
+	}
+}
+
+func TestBodyRewriteApplies(t *testing.T) {
+	rewrite := mustMapResponseRewrite(t, &ResponseRewriteConfig{Body: &BodyRewriteConfig{MaxSize: 100}})
+	for _, test := range []struct {
+		name     string
+		header   http.Header
+		length   int64
+		expected bool
+	}{
+		{"html", http.Header{"Content-Type": {"text/html; charset=utf-8"}}, 10, true},
+		{"json of unknown length", http.Header{"Content-Type": {"application/json"}}, -1, true},
+		{"image", http.Header{"Content-Type": {"image/png"}}, 10, false},
+		{"encoded", http.Header{"Content-Type": {"text/html"}, "Content-Encoding": {"gzip"}}, 10, false},
+		{"larger than max_size", http.Header{"Content-Type": {"text/html"}}, 101, false},
+		{"no content type", http.Header{}, 10, false},
+	} {
+		resp := &http.Response{Header: test.header, ContentLength: test.length, Body: io.NopCloser(strings.NewReader("body"))}
+		if applies := rewrite.body.applies(resp); applies != test.expected {
+			t.Errorf("%s: applies was %v", test.name, applies)
+		}
+	}
+}
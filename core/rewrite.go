@@ -0,0 +1,239 @@
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+)
+
+// RewriteRuleConfig  config of a conditional rewrite. Match and Replace work as
+// a RewriteConfigString; the rule only applies when every condition holds.
+// Methods and Topologies match any listed value, Host and Headers are regexes
+// over the request host and named header values
+type RewriteRuleConfig struct {
+	Match         string            `json:"match" yaml:"match"`
+	Replace       string            `json:"replace" yaml:"replace"`
+	Methods       []string          `json:"methods,omitempty" yaml:"methods,omitempty"`
+	Host          string            `json:"host,omitempty" yaml:"host,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	Topologies    []TopologyKey     `json:"topologies,omitempty" yaml:"topologies,omitempty"`
+	SetHeaders    map[string]string `json:"set_headers,omitempty" yaml:"set_headers,omitempty"`
+	RemoveHeaders []string          `json:"remove_headers,omitempty" yaml:"remove_headers,omitempty"`
+}
+
+type rewriteRule struct {
+	pattern       *regexp.Regexp
+	rewrite       stringRewrite
+	prefix        string
+	anchored      bool
+	methods       map[string]bool
+	host          *regexp.Regexp
+	headers       map[string]*regexp.Regexp
+	topologies    map[TopologyKey]bool
+	setHeaders    map[string]string
+	removeHeaders []string
+}
+
+func newRewriteRule(match string, replace string) (rewriteRule, error) {
+	pattern, err := regexp.Compile(match)
+	if err != nil {
+		return rewriteRule{}, err
+	}
+	prefix, _ := pattern.LiteralPrefix()
+	return rewriteRule{
+		pattern:  pattern,
+		rewrite:  regexReplaceRewrite(pattern, replace),
+		prefix:   prefix,
+		anchored: anchoredAtStart(match),
+		headers:  make(map[string]*regexp.Regexp),
+	}, nil
+}
+
+// anchoredAtStart reports whether every match of pattern begins at the start of the input
+func anchoredAtStart(pattern string) bool {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return false
+	}
+	for (re.Op == syntax.OpConcat || re.Op == syntax.OpCapture) && len(re.Sub) > 0 {
+		re = re.Sub[0]
+	}
+	return re.Op == syntax.OpBeginText
+}
+
+func mapRewriteConfigString(rewrite RewriteConfigString) (rewriteRule, error) {
+	match, replace, err := parseRewriteConfigString(rewrite)
+	if err != nil {
+		return rewriteRule{}, err
+	}
+	return newRewriteRule(match, replace)
+}
+
+func mapRewriteRuleConfig(ruleConfig RewriteRuleConfig) (rewriteRule, error) {
+	rule, err := newRewriteRule(ruleConfig.Match, ruleConfig.Replace)
+	if err != nil {
+		return rewriteRule{}, fmt.Errorf("match: %s", err)
+	}
+	rule.setHeaders = ruleConfig.SetHeaders
+	rule.removeHeaders = ruleConfig.RemoveHeaders
+
+	if len(ruleConfig.Methods) > 0 {
+		rule.methods = make(map[string]bool)
+		for _, method := range ruleConfig.Methods {
+			rule.methods[strings.ToUpper(method)] = true
+		}
+	}
+
+	if ruleConfig.Host != "" {
+		rule.host, err = regexp.Compile(ruleConfig.Host)
+		if err != nil {
+			return rewriteRule{}, fmt.Errorf("host: %s", err)
+		}
+	}
+
+	for name, pattern := range ruleConfig.Headers {
+		rule.headers[name], err = regexp.Compile(pattern)
+		if err != nil {
+			return rewriteRule{}, fmt.Errorf("headers.%s: %s", name, err)
+		}
+	}
+
+	if len(ruleConfig.Topologies) > 0 {
+		rule.topologies = make(map[TopologyKey]bool)
+		for _, topology := range ruleConfig.Topologies {
+			rule.topologies[topology] = true
+		}
+	}
+
+	return rule, nil
+}
+
+func (rule *rewriteRule) matches(input string, req *http.Request, topology TopologyKey) bool {
+	if rule.methods != nil && !rule.methods[req.Method] {
+		return false
+	}
+	if rule.host != nil && !rule.host.MatchString(req.URL.Host) {
+		return false
+	}
+	for name, pattern := range rule.headers {
+		if !pattern.MatchString(req.Header.Get(name)) {
+			return false
+		}
+	}
+	if rule.topologies != nil && !rule.topologies[topology] {
+		return false
+	}
+	return rule.pattern.MatchString(input)
+}
+
+// apply rewrites input when the rule's conditions hold, editing the request
+// headers as the rule directs
+func (rule *rewriteRule) apply(input string, req *http.Request, topology TopologyKey) string {
+	if !rule.matches(input, req, topology) {
+		return input
+	}
+
+	for _, name := range rule.removeHeaders {
+		req.Header.Del(name)
+	}
+	for name, value := range rule.setHeaders {
+		req.Header.Set(name, value)
+	}
+
+	return rule.rewrite(input)
+}
+
+// rewriteEngine - rewrite rules compiled for first match wins matching. Every
+// match of a rule begins with the rule's literal prefix, so rules anchored to
+// the start of the url are indexed by that prefix in a trie, and the others
+// are only tried when the url contains it
+type rewriteEngine struct {
+	rules        []rewriteRule
+	anchored     *prefixTrie
+	floating     []int
+	headers      []string
+	editsHeaders bool
+}
+
+// prefixTrie - rule indexes by literal prefix
+type prefixTrie struct {
+	rules    []int
+	children map[byte]*prefixTrie
+}
+
+func newRewriteEngine(rules []rewriteRule) *rewriteEngine {
+	engine := &rewriteEngine{rules: rules, anchored: &prefixTrie{}}
+	seen := make(map[string]bool)
+	for i, rule := range rules {
+		if rule.anchored {
+			engine.anchored.insert(rule.prefix, i)
+		} else {
+			engine.floating = append(engine.floating, i)
+		}
+		for name := range rule.headers {
+			name = http.CanonicalHeaderKey(name)
+			if !seen[name] {
+				seen[name] = true
+				engine.headers = append(engine.headers, name)
+			}
+		}
+		if len(rule.setHeaders) > 0 || len(rule.removeHeaders) > 0 {
+			engine.editsHeaders = true
+		}
+	}
+	sort.Strings(engine.headers)
+	return engine
+}
+
+func (trie *prefixTrie) insert(prefix string, index int) {
+	node := trie
+	for i := 0; i < len(prefix); i++ {
+		child := node.children[prefix[i]]
+		if child == nil {
+			if node.children == nil {
+				node.children = make(map[byte]*prefixTrie)
+			}
+			child = &prefixTrie{}
+			node.children[prefix[i]] = child
+		}
+		node = child
+	}
+	node.rules = append(node.rules, index)
+}
+
+// collect appends the rules whose prefix begins input
+func (trie *prefixTrie) collect(input string, candidates []int) []int {
+	node := trie
+	candidates = append(candidates, node.rules...)
+	for i := 0; i < len(input); i++ {
+		node = node.children[input[i]]
+		if node == nil {
+			break
+		}
+		candidates = append(candidates, node.rules...)
+	}
+	return candidates
+}
+
+// apply returns the result of the first rule, in config order, which changes input
+func (engine *rewriteEngine) apply(input string, req *http.Request, topology TopologyKey) string {
+	var buffer [16]int
+	candidates := engine.anchored.collect(input, buffer[:0])
+	for _, index := range engine.floating {
+		if strings.Contains(input, engine.rules[index].prefix) {
+			candidates = append(candidates, index)
+		}
+	}
+	sort.Ints(candidates)
+
+	for _, index := range candidates {
+		result := engine.rules[index].apply(input, req, topology)
+		if result != input {
+			return result
+		}
+	}
+	return input
+}
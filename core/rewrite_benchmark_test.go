@@ -0,0 +1,84 @@
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// benchmarkRules builds count anchored host rules, as written for moving
+// clients between hostnames, with a floating rule every tenth rule
+func benchmarkRules(b *testing.B, count int) []rewriteRule {
+	rules := make([]rewriteRule, 0, count)
+	for i := 0; i < count; i++ {
+		match, replace := fmt.Sprintf("^//svc%d\\.example\\.com/old/(.*)$", i), fmt.Sprintf("//svc%d.example.com/new/$1", i)
+		if i%10 == 0 {
+			match, replace = fmt.Sprintf("/legacy%d/(.*)$", i), "/current/$1"
+		}
+		rule, err := newRewriteRule(match, replace)
+		if err != nil {
+			b.Fatal(err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// linearApply is the rule by rule scan the engine replaces
+func linearApply(rules []rewriteRule, input string, req *http.Request, topology TopologyKey) string {
+	for i := range rules {
+		result := rules[i].apply(input, req, topology)
+		if result != input {
+			return result
+		}
+	}
+	return input
+}
+
+func benchmarkInputs(count int) map[string]string {
+	return map[string]string{
+		"match":   fmt.Sprintf("//svc%d.example.com/old/path", count-1),
+		"nomatch": "//unknown.example.com/old/path",
+	}
+}
+
+func BenchmarkRewriteLinear(b *testing.B) {
+	for _, count := range []int{10, 100, 1000} {
+		rules := benchmarkRules(b, count)
+		for name, input := range benchmarkInputs(count) {
+			b.Run(fmt.Sprintf("%d/%s", count, name), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					linearApply(rules, input, nil, "")
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkRewriteEngine(b *testing.B) {
+	for _, count := range []int{10, 100, 1000} {
+		rules := benchmarkRules(b, count)
+		engine := newRewriteEngine(rules)
+		for name, input := range benchmarkInputs(count) {
+			if expected, actual := linearApply(rules, input, nil, ""), engine.apply(input, nil, ""); expected != actual {
+				b.Fatalf("engine rewrote %s to %s, expected %s", input, actual, expected)
+			}
+			b.Run(fmt.Sprintf("%d/%s", count, name), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					engine.apply(input, nil, "")
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkRewriteURL(b *testing.B) {
+	config := &config{rewrites: newRewriteEngine(benchmarkRules(b, 1000))}
+	req := httptest.NewRequest("GET", "http://unknown.example.com/old/path", nil)
+	req.URL.Host = req.Host
+
+	for i := 0; i < b.N; i++ {
+		rewriteURL(config, req, "")
+	}
+}
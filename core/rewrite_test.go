@@ -0,0 +1,170 @@
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newRewriteRequest(method string, host string, header http.Header) *http.Request {
+	req := httptest.NewRequest(method, "http://"+host+"/old/path", nil)
+	req.URL.Host = req.Host
+	req.URL.Scheme = ""
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	return req
+}
+
+func TestRewriteRuleConditions(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   RewriteRuleConfig
+		method   string
+		host     string
+		header   http.Header
+		topology TopologyKey
+		matches  bool
+	}{
+		{"unconditional", RewriteRuleConfig{}, "GET", "a.example.com", nil, "", true},
+		{"method", RewriteRuleConfig{Methods: []string{"get", "HEAD"}}, "GET", "a.example.com", nil, "", true},
+		{"other method", RewriteRuleConfig{Methods: []string{"GET"}}, "POST", "a.example.com", nil, "", false},
+		{"host", RewriteRuleConfig{Host: `^a\.example\.com$`}, "GET", "a.example.com", nil, "", true},
+		{"other host", RewriteRuleConfig{Host: `^a\.example\.com$`}, "GET", "b.example.com", nil, "", false},
+		{"header", RewriteRuleConfig{Headers: map[string]string{"user-agent": "^Legacy/"}}, "GET", "a.example.com", http.Header{"User-Agent": {"Legacy/1.0"}}, "", true},
+		{"other header value", RewriteRuleConfig{Headers: map[string]string{"user-agent": "^Legacy/"}}, "GET", "a.example.com", http.Header{"User-Agent": {"Modern/1.0"}}, "", false},
+		{"missing header", RewriteRuleConfig{Headers: map[string]string{"user-agent": "^Legacy/"}}, "GET", "a.example.com", nil, "", false},
+		{"every header", RewriteRuleConfig{Headers: map[string]string{"user-agent": "^Legacy/", "x-beta": "^1$"}}, "GET", "a.example.com", http.Header{"User-Agent": {"Legacy/1.0"}}, "", false},
+		{"topology", RewriteRuleConfig{Topologies: []TopologyKey{"dev", "qa"}}, "GET", "a.example.com", nil, "qa", true},
+		{"other topology", RewriteRuleConfig{Topologies: []TopologyKey{"dev"}}, "GET", "a.example.com", nil, "", false},
+		{"every condition", RewriteRuleConfig{Methods: []string{"GET"}, Host: "example", Headers: map[string]string{"x-beta": "1"}, Topologies: []TopologyKey{"dev"}}, "GET", "a.example.com", http.Header{"X-Beta": {"1"}}, "dev", true},
+	}
+
+	for _, test := range tests {
+		test.config.Match = "/old/(.*)$"
+		test.config.Replace = "/new/$1"
+		rule, err := mapRewriteRuleConfig(test.config)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		req := newRewriteRequest(test.method, test.host, test.header)
+		input := req.URL.String()
+		result := rule.apply(input, req, test.topology)
+		if matched := result != input; matched != test.matches {
+			t.Errorf("%s: rewrote %s to %s, expected a match: %v", test.name, input, result, test.matches)
+		}
+	}
+}
+
+func TestRewriteRuleEditsHeadersOnlyWhenMatched(t *testing.T) {
+	rule, err := mapRewriteRuleConfig(RewriteRuleConfig{
+		Match:         "^//legacy\\.example\\.com/(.*)$",
+		Replace:       "//echo.example.com/$1",
+		Methods:       []string{"GET"},
+		SetHeaders:    map[string]string{"x-byway-min": "1.0.0"},
+		RemoveHeaders: []string{"cookie"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := http.Header{"Cookie": {"session=1"}}
+	for _, req := range []*http.Request{
+		newRewriteRequest("POST", "legacy.example.com", header),
+		newRewriteRequest("GET", "other.example.com", header),
+	} {
+		rule.apply(req.URL.String(), req, "")
+		if req.Header.Get("Cookie") == "" || req.Header.Get("X-Byway-Min") != "" {
+			t.Errorf("%s %s: headers edited without a match: %v", req.Method, req.Host, req.Header)
+		}
+	}
+
+	req := newRewriteRequest("GET", "legacy.example.com", header)
+	result := rule.apply(req.URL.String(), req, "")
+	if result != "//echo.example.com/old/path" {
+		t.Errorf("rewrote to %s", result)
+	}
+	if req.Header.Get("Cookie") != "" || req.Header.Get("X-Byway-Min") != "1.0.0" {
+		t.Errorf("headers not edited on a match: %v", req.Header)
+	}
+}
+
+func TestRewriteRuleConfigErrors(t *testing.T) {
+	for prefix, config := range map[string]RewriteRuleConfig{
+		"match:":         {Match: "(", Replace: "x"},
+		"host:":          {Match: "a", Replace: "b", Host: "["},
+		"headers.X-Foo:": {Match: "a", Replace: "b", Headers: map[string]string{"X-Foo": "*"}},
+	} {
+		_, err := mapRewriteRuleConfig(config)
+		if err == nil || !strings.HasPrefix(err.Error(), prefix) {
+			t.Errorf("expected an error starting %q, got %v", prefix, err)
+		}
+	}
+}
+
+func TestRewriteEngineMatchesLinearScan(t *testing.T) {
+	rules := make([]rewriteRule, 0)
+	for _, rewrite := range []string{
+		`^//a\.example\.com/old/(.*)$;//a.example.com/new/$1`,
+		`^//a\.example\.com/(.*)$;//a.example.com/any/$1`,
+		`/legacy/(.*)$;/current/$1`,
+		`;/empty`,
+		`^;//prefixed`,
+		`(?i)^//B\.EXAMPLE\.COM/(.*)$;//b.example.com/folded/$1`,
+		`(?m)^//c\.example\.com/(.*)$;//c.example.com/multiline/$1`,
+		`^//(d|e)\.example\.com/(.*)$;//alternated.example.com/$2`,
+		`(old|legacy)/path$;replaced/path`,
+	} {
+		rule, err := mapRewriteConfigString(RewriteConfigString(rewrite))
+		if err != nil {
+			t.Fatalf("%s: %s", rewrite, err)
+		}
+		rules = append(rules, rule)
+	}
+	for _, config := range []RewriteRuleConfig{
+		{Match: `^//f\.example\.com/(.*)$`, Replace: "//f.example.com/post/$1", Methods: []string{"POST"}},
+		{Match: `^//f\.example\.com/(.*)$`, Replace: "//f.example.com/dev/$1", Topologies: []TopologyKey{"dev"}},
+		{Match: `/old/`, Replace: "/beta/", Headers: map[string]string{"x-beta": "1"}, SetHeaders: map[string]string{"x-rewritten": "yes"}},
+	} {
+		rule, err := mapRewriteRuleConfig(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, rule)
+	}
+	// in config order, then with each rule moved ahead of the others
+	orders := [][]rewriteRule{rules}
+	for i := range rules {
+		order := append([]rewriteRule{rules[i]}, rules[:i]...)
+		orders = append(orders, append(order, rules[i+1:]...))
+	}
+
+	hosts := []string{"a.example.com", "b.example.com", "B.example.com", "c.example.com", "d.example.com", "e.example.com", "f.example.com", "unknown.example.com"}
+	paths := []string{"/old/path", "/legacy/path", "/"}
+	for _, order := range orders {
+		engine := newRewriteEngine(order)
+		for _, host := range hosts {
+			for _, path := range paths {
+				for _, method := range []string{"GET", "POST"} {
+					for _, topology := range []TopologyKey{"", "dev"} {
+						for _, header := range []http.Header{nil, {"X-Beta": {"1"}}} {
+							linear := newRewriteRequest(method, host, header)
+							indexed := newRewriteRequest(method, host, header)
+							linear.URL.Path, indexed.URL.Path = path, path
+							input := linear.URL.String()
+							expected := linearApply(order, input, linear, topology)
+							actual := engine.apply(input, indexed, topology)
+							if actual != expected {
+								t.Errorf("%s %s %s %v: engine rewrote to %s, expected %s", method, input, topology, header, actual, expected)
+							}
+							if linear.Header.Get("X-Rewritten") != indexed.Header.Get("X-Rewritten") {
+								t.Errorf("%s %s %s %v: engine edited headers %v, expected %v", method, input, topology, header, indexed.Header, linear.Header)
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+type routeContextKey struct{}
+
+// route - the routing decisions made for a single request, shared between
+// the director, the transport and the access log
+type route struct {
+	listener       string
+	host           string
+	acceptEncoding string
+	binding        *binding
+	rewritten      *url.URL
+	topology       TopologyKey
+	failure        string
+	requestID      string
+	clientIP       string
+	authorized     bool
+	rateLimits     []rateLimitBucket
+	err            error
+}
+
+// routeError - a request which could not be routed, and the status to answer it with
+type routeError struct {
+	status  int
+	message string
+}
+
+func (e *routeError) Error() string {
+	return e.message
+}
+
+func withRoute(listener string, inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), routeContextKey{}, &route{listener: listener})
+		inner.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func routeFromContext(ctx context.Context) *route {
+	r, ok := ctx.Value(routeContextKey{}).(*route)
+	if !ok {
+		return &route{}
+	}
+	return r
+}
+
+// bywayTransport - round trips requests according to their route
+type bywayTransport struct {
+	http.RoundTripper
+}
+
+func (t *bywayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	route := routeFromContext(req.Context())
+	if route.err != nil {
+		return nil, route.err
+	}
+
+	binding := route.binding
+	next := t.RoundTripper.RoundTrip
+	if binding != nil && binding.proxyProtocol != 0 {
+		next = newProxyProtocolTransport(req, binding.proxyProtocol).RoundTrip
+	}
+
+	var limit *rateLimitStatus
+	if len(route.rateLimits) > 0 {
+		limit = limiter.take(route.rateLimits)
+		if !limit.allowed {
+			return limit.tooManyRequests(req), nil
+		}
+	}
+
+	var resp *http.Response
+	var err error
+	if binding != nil && binding.cache {
+		resp, err = httpCache.roundTrip(req, route, next)
+	} else {
+		resp, err = next(req)
+	}
+	if err == nil && limit != nil {
+		limit.setHeaders(resp.Header)
+	}
+	return resp, err
+}
+
+// modifyResponse decodes encodings the client can not accept, then applies
+// the response rewrite, header policy, compression and buffering of the binding
+func modifyResponse(resp *http.Response) error {
+	route := routeFromContext(resp.Request.Context())
+	if route.binding == nil {
+		return nil
+	}
+	err := route.binding.compression.decode(resp, route.acceptEncoding)
+	if err != nil {
+		return err
+	}
+	values := newHeaderValues(resp.Request, route)
+	route.binding.responseRewrite.apply(resp, route.binding, values)
+	route.binding.responseHeaders.apply(resp.Header, values)
+	route.binding.compression.encode(resp, route.acceptEncoding, route.binding.body.streamed())
+	return route.binding.body.readResponse(resp)
+}
+
+func proxyErrorHandler(w http.ResponseWriter, req *http.Request, err error) {
+	status := http.StatusBadGateway
+	var routeErr *routeError
+	if errors.As(err, &routeErr) {
+		status = routeErr.status
+	} else {
+		logger.WarnContext(req.Context(), "proxy error", "url", req.URL, "err", err)
+		if binding := routeFromContext(req.Context()).binding; binding != nil {
+			metrics.upstreamErrors.WithLabelValues(string(binding.service), string(binding.version), binding.host).Inc()
+		}
+	}
+	writeError(w, req, status)
+}
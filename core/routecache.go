@@ -0,0 +1,188 @@
+package core
+
+import (
+	"container/list"
+	"expvar"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const defaultRouteCacheSize = 10000
+
+// RouteCacheConfig - bounds of the route resolution cache. A Size of 0 uses
+// the default, a negative Size disables the cache
+type RouteCacheConfig struct {
+	Size int `json:"size" yaml:"size"`
+}
+
+// RouteCacheStats - counters of the route resolution cache
+type RouteCacheStats struct {
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+	Entries int    `json:"entries"`
+	Size    int    `json:"size"`
+}
+
+// routeKey - every input that rewriting and resolution depend on
+type routeKey struct {
+	generation uint64
+	listener   string
+	method     string
+	url        string
+	topology   string
+	min        string
+	max        string
+	service    string
+	headers    string
+}
+
+// resolvedRoute - the outcome of rewriting and resolving a request
+type resolvedRoute struct {
+	url       *url.URL
+	host      string
+	topology  TopologyKey
+	binding   *binding
+	rewritten bool
+	failure   string
+	err       error
+}
+
+type routeCacheEntry struct {
+	key   routeKey
+	route resolvedRoute
+}
+
+// routeCache - bounded LRU of resolved routes. Entries are keyed on the config
+// generation, so a stale entry can never be served after a config swap
+type routeCache struct {
+	lock    sync.Mutex
+	size    int
+	entries map[routeKey]*list.Element
+	order   *list.List
+	hits    atomic.Uint64
+	misses  atomic.Uint64
+}
+
+var resolutionCache = newRouteCache(defaultRouteCacheSize)
+
+func init() {
+	expvar.Publish("byway.route_cache", expvar.Func(func() interface{} {
+		return GetRouteCacheStats()
+	}))
+}
+
+// GetRouteCacheStats - hit and miss counters of the route resolution cache
+func GetRouteCacheStats() RouteCacheStats {
+	return resolutionCache.stats()
+}
+
+func newRouteCache(size int) *routeCache {
+	return &routeCache{
+		size:    size,
+		entries: make(map[routeKey]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func routeCacheSize(cfg *RouteCacheConfig) int {
+	if cfg == nil || cfg.Size == 0 {
+		return defaultRouteCacheSize
+	}
+	if cfg.Size < 0 {
+		return 0
+	}
+	return cfg.Size
+}
+
+// newRouteKey - builds the cache key for req, false when the request can not be cached
+func newRouteKey(config *config, listener string, req *http.Request) (routeKey, bool) {
+	if config.rewrites.editsHeaders {
+		return routeKey{}, false
+	}
+	key := routeKey{
+		generation: config.generation,
+		listener:   listener,
+		method:     req.Method,
+		url:        req.URL.String(),
+		topology:   req.Header.Get("x-byway-topology"),
+		min:        req.Header.Get("x-byway-min"),
+		max:        req.Header.Get("x-byway-max"),
+		service:    req.Header.Get("x-byway-service"),
+	}
+	if len(config.rewrites.headers) > 0 {
+		values := make([]string, len(config.rewrites.headers))
+		for i, name := range config.rewrites.headers {
+			values[i] = strings.Join(req.Header[name], ",")
+		}
+		key.headers = strings.Join(values, "\x00")
+	}
+	return key, true
+}
+
+func (cache *routeCache) get(key routeKey) (resolvedRoute, bool) {
+	cache.lock.Lock()
+	var route resolvedRoute
+	element, ok := cache.entries[key]
+	if ok {
+		cache.order.MoveToFront(element)
+		route = element.Value.(*routeCacheEntry).route
+	}
+	cache.lock.Unlock()
+
+	if !ok {
+		cache.misses.Add(1)
+		return route, false
+	}
+	cache.hits.Add(1)
+	return route, true
+}
+
+func (cache *routeCache) add(key routeKey, route resolvedRoute) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if cache.size <= 0 {
+		return
+	}
+	if element, ok := cache.entries[key]; ok {
+		element.Value.(*routeCacheEntry).route = route
+		cache.order.MoveToFront(element)
+		return
+	}
+	cache.entries[key] = cache.order.PushFront(&routeCacheEntry{key, route})
+	for cache.order.Len() > cache.size {
+		cache.evict()
+	}
+}
+
+// reset - drops every entry and applies a new bound
+func (cache *routeCache) reset(size int) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	cache.size = size
+	cache.entries = make(map[routeKey]*list.Element)
+	cache.order.Init()
+}
+
+func (cache *routeCache) evict() {
+	oldest := cache.order.Back()
+	cache.order.Remove(oldest)
+	delete(cache.entries, oldest.Value.(*routeCacheEntry).key)
+}
+
+func (cache *routeCache) stats() RouteCacheStats {
+	cache.lock.Lock()
+	entries, size := cache.order.Len(), cache.size
+	cache.lock.Unlock()
+
+	return RouteCacheStats{
+		Hits:    cache.hits.Load(),
+		Misses:  cache.misses.Load(),
+		Entries: entries,
+		Size:    size,
+	}
+}
@@ -0,0 +1,171 @@
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newRouteCacheTestConfig(t *testing.T, rules ...RewriteRuleConfig) *config {
+	t.Helper()
+	rawConfig := NewConfig()
+	rawConfig.RewriteRules = rules
+	config, err := mapConfig(rawConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func routeKeyOf(t *testing.T, config *config, listener string, method string, target string, header http.Header) routeKey {
+	t.Helper()
+	req := httptest.NewRequest(method, target, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	key, ok := newRouteKey(config, listener, req)
+	if !ok {
+		t.Fatalf("%s %s was not cacheable", method, target)
+	}
+	return key
+}
+
+func TestRouteCacheMissesAfterReload(t *testing.T) {
+	cache := newRouteCache(10)
+	config := newRouteCacheTestConfig(t)
+	config.generation = 1
+	cache.add(routeKeyOf(t, config, "default", "GET", "http://echo.example.com/", nil), resolvedRoute{host: "echo.example.com"})
+
+	if _, hit := cache.get(routeKeyOf(t, config, "default", "GET", "http://echo.example.com/", nil)); !hit {
+		t.Error("same request missed the cache")
+	}
+	reloaded := newRouteCacheTestConfig(t)
+	reloaded.generation = 2
+	if _, hit := cache.get(routeKeyOf(t, reloaded, "default", "GET", "http://echo.example.com/", nil)); hit {
+		t.Error("request after a reload hit the cache")
+	}
+}
+
+func TestRouteCacheKeyInputs(t *testing.T) {
+	config := newRouteCacheTestConfig(t, RewriteRuleConfig{
+		Match:   "^//legacy\\.example\\.com/(.*)$",
+		Replace: "//echo.example.com/$1",
+		Headers: map[string]string{"user-agent": "^LegacyClient/"},
+	})
+	base := routeKeyOf(t, config, "default", "GET", "http://echo.example.com/a", http.Header{"User-Agent": {"LegacyClient/1"}})
+
+	for name, key := range map[string]routeKey{
+		"listener":         routeKeyOf(t, config, "internal", "GET", "http://echo.example.com/a", http.Header{"User-Agent": {"LegacyClient/1"}}),
+		"method":           routeKeyOf(t, config, "default", "POST", "http://echo.example.com/a", http.Header{"User-Agent": {"LegacyClient/1"}}),
+		"url":              routeKeyOf(t, config, "default", "GET", "http://echo.example.com/b", http.Header{"User-Agent": {"LegacyClient/1"}}),
+		"condition header": routeKeyOf(t, config, "default", "GET", "http://echo.example.com/a", http.Header{"User-Agent": {"Modern/1"}}),
+		"x-byway-topology": routeKeyOf(t, config, "default", "GET", "http://echo.example.com/a", http.Header{"User-Agent": {"LegacyClient/1"}, "X-Byway-Topology": {"dev"}}),
+		"x-byway-min":      routeKeyOf(t, config, "default", "GET", "http://echo.example.com/a", http.Header{"User-Agent": {"LegacyClient/1"}, "X-Byway-Min": {"1.0.0"}}),
+		"x-byway-max":      routeKeyOf(t, config, "default", "GET", "http://echo.example.com/a", http.Header{"User-Agent": {"LegacyClient/1"}, "X-Byway-Max": {"1.0.0"}}),
+		"x-byway-service":  routeKeyOf(t, config, "default", "GET", "http://echo.example.com/a", http.Header{"User-Agent": {"LegacyClient/1"}, "X-Byway-Service": {"search"}}),
+	} {
+		if key == base {
+			t.Errorf("requests differing by %s share a cache key", name)
+		}
+	}
+
+	unrelated := routeKeyOf(t, config, "default", "GET", "http://echo.example.com/a", http.Header{"User-Agent": {"LegacyClient/1"}, "Accept": {"text/html"}})
+	if unrelated != base {
+		t.Error("a header no rule matches on changed the cache key")
+	}
+}
+
+func TestRouteCacheBypassedWhenRulesEditHeaders(t *testing.T) {
+	config := newRouteCacheTestConfig(t, RewriteRuleConfig{
+		Match:      "^//legacy\\.example\\.com/(.*)$",
+		Replace:    "//echo.example.com/$1",
+		SetHeaders: map[string]string{"x-byway-min": "1.0.0"},
+	})
+	req := httptest.NewRequest("GET", "http://echo.example.com/", nil)
+	if _, ok := newRouteKey(config, "default", req); ok {
+		t.Error("request was cacheable under rules which edit headers")
+	}
+}
+
+func TestRouteCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newRouteCache(2)
+	a, b, c := routeKey{url: "a"}, routeKey{url: "b"}, routeKey{url: "c"}
+	cache.add(a, resolvedRoute{})
+	cache.add(b, resolvedRoute{})
+	cache.get(a)
+	cache.add(c, resolvedRoute{})
+
+	if _, hit := cache.get(b); hit {
+		t.Error("least recently used entry was kept")
+	}
+	if _, hit := cache.get(a); !hit {
+		t.Error("recently used entry was evicted")
+	}
+
+	cache.reset(0)
+	cache.add(a, resolvedRoute{})
+	if _, hit := cache.get(a); hit {
+		t.Error("disabled cache stored an entry")
+	}
+}
+
+func TestRouteCacheFollowsReloadsAndConditionHeaders(t *testing.T) {
+	upstream := func(name string) string {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		t.Cleanup(server.Close)
+		return strings.TrimPrefix(server.URL, "http://")
+	}
+	first, second, legacy := upstream("first"), upstream("second"), upstream("legacy")
+
+	mapTestConfig := func(echo string, generation uint64) *config {
+		rawConfig := NewConfig()
+		rawConfig.Mapping["echo"] = map[VersionString]EndpointConfig{"1.0.0": {Host: echo, Scheme: "http"}}
+		rawConfig.Mapping["legacy"] = map[VersionString]EndpointConfig{"1.0.0": {Host: legacy, Scheme: "http"}}
+		rawConfig.RewriteRules = []RewriteRuleConfig{{
+			Match:   `^//echo\.example\.com/(.*)$`,
+			Replace: "//legacy.example.com/$1",
+			Headers: map[string]string{"user-agent": "^LegacyClient/"},
+		}}
+		config, err := mapConfig(rawConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.generation = generation
+		return config
+	}
+
+	resolutionCache.reset(routeCacheSize(nil))
+	state := newProxyState()
+	state.current.Store(mapTestConfig(first, 1))
+	handler := withRoute(defaultListenerName, newBywayHandler(state))
+	get := func(userAgent string) string {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = "echo.example.com"
+		req.Header.Set("User-Agent", userAgent)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder.Body.String()
+	}
+
+	for _, step := range []struct{ userAgent, expected string }{
+		{"Modern/1", "first"},
+		{"LegacyClient/1", "legacy"},
+		{"Modern/1", "first"},
+		{"LegacyClient/1", "legacy"},
+	} {
+		if body := get(step.userAgent); body != step.expected {
+			t.Errorf("%s routed to %s, expected %s", step.userAgent, body, step.expected)
+		}
+	}
+	if hits := resolutionCache.stats().Hits; hits == 0 {
+		t.Error("repeated requests never hit the route cache")
+	}
+
+	state.current.Store(mapTestConfig(second, 2))
+	if body := get("Modern/1"); body != "second" {
+		t.Errorf("after a reload routed to %s, expected second", body)
+	}
+}
@@ -0,0 +1,240 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SecretKeyEnv - the environment variable holding the base64 encoded AES key
+// which encrypts Config.Secrets
+const SecretKeyEnv = "BYWAY_SECRET_KEY"
+
+// SecretDirEnv - the environment variable naming the directory {file:PATH}
+// secrets are read from; without it {file:} is refused
+const SecretDirEnv = "BYWAY_SECRET_DIR"
+
+const redacted = "[redacted]"
+
+// secretSources - the sources a header value may read a secret from, as
+// {env:NAME}, {file:PATH} for a file under SecretDirEnv or {secret:NAME} for an
+// entry of Config.Secrets
+var secretSources = map[string]bool{
+	"env":    true,
+	"file":   true,
+	"secret": true,
+}
+
+// secretStore resolves secret references while a config is mapped
+type secretStore struct {
+	encrypted map[string]string
+}
+
+func isSecretReference(field string) bool {
+	source, _, ok := strings.Cut(field, ":")
+	return ok && secretSources[source]
+}
+
+func (s *secretStore) resolve(reference string) (string, error) {
+	source, name, _ := strings.Cut(reference, ":")
+	switch source {
+	case "env":
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value, nil
+	case "file":
+		path, err := secretFilePath(name)
+		if err != nil {
+			return "", err
+		}
+		value, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(value), "\r\n"), nil
+	case "secret":
+		ciphertext, ok := s.encrypted[name]
+		if !ok {
+			return "", fmt.Errorf("secret %s does not exist", name)
+		}
+		value, err := decryptSecret(ciphertext)
+		if err != nil {
+			return "", fmt.Errorf("secret %s: %s", name, err)
+		}
+		return value, nil
+	}
+	return "", fmt.Errorf("unknown secret source %s", source)
+}
+
+// secretFilePath resolves name within SecretDirEnv, refusing absolute names
+// and names which leave the directory, through .. or a symlink
+func secretFilePath(name string) (string, error) {
+	dir := os.Getenv(SecretDirEnv)
+	if dir == "" {
+		return "", fmt.Errorf("file secrets need %s to be set", SecretDirEnv)
+	}
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("file secret %s is not within %s", name, SecretDirEnv)
+	}
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	path, err := filepath.EvalSymlinks(filepath.Join(dir, name))
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+		return "", fmt.Errorf("file secret %s is not within %s", name, SecretDirEnv)
+	}
+	return path, nil
+}
+
+func secretCipher() (cipher.AEAD, error) {
+	encoded := os.Getenv(SecretKeyEnv)
+	if encoded == "" {
+		return nil, fmt.Errorf("%s is not set", SecretKeyEnv)
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", SecretKeyEnv, err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", SecretKeyEnv, err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptSecret - encrypts value for Config.Secrets with the key in SecretKeyEnv
+func EncryptSecret(value string) (string, error) {
+	aead, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(value), nil)), nil
+}
+
+func decryptSecret(encoded string) (string, error) {
+	aead, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("ciphertext too short")
+	}
+	value, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt")
+	}
+	return string(value), nil
+}
+
+// RedactSecrets - a copy of rawConfig safe to show, without encrypted secrets,
+// the debug and admin tokens, header values other than Host or public hosts
+// which refer to secrets
+func RedactSecrets(rawConfig *Config) *Config {
+	copied := *rawConfig
+
+	if rawConfig.Secrets != nil {
+		copied.Secrets = make(map[string]string, len(rawConfig.Secrets))
+		for name := range rawConfig.Secrets {
+			copied.Secrets[name] = redacted
+		}
+	}
+
+	if rawConfig.Logging != nil && rawConfig.Logging.DebugToken != "" {
+		logging := *rawConfig.Logging
+		logging.DebugToken = redacted
+		copied.Logging = &logging
+	}
+
+	if rawConfig.Admin != nil && rawConfig.Admin.Token != "" {
+		admin := *rawConfig.Admin
+		admin.Token = redacted
+		copied.Admin = &admin
+	}
+
+	copied.Mapping = make(map[ServiceName]map[VersionString]EndpointConfig, len(rawConfig.Mapping))
+	for service, versions := range rawConfig.Mapping {
+		copiedVersions := make(map[VersionString]EndpointConfig, len(versions))
+		for version, endpoint := range versions {
+			endpoint.Headers = redactHeaders(endpoint.Headers)
+			endpoint.RequestHeaders = redactHeaderPolicy(endpoint.RequestHeaders)
+			endpoint.ResponseHeaders = redactHeaderPolicy(endpoint.ResponseHeaders)
+			if endpoint.ResponseRewrite != nil && referencesSecret(endpoint.ResponseRewrite.PublicHost) {
+				responseRewrite := *endpoint.ResponseRewrite
+				responseRewrite.PublicHost = redacted
+				endpoint.ResponseRewrite = &responseRewrite
+			}
+			copiedVersions[version] = endpoint
+		}
+		copied.Mapping[service] = copiedVersions
+	}
+	return &copied
+}
+
+func redactHeaderPolicy(policy *HeaderPolicy) *HeaderPolicy {
+	if policy == nil {
+		return nil
+	}
+	return &HeaderPolicy{
+		Set:    redactHeaders(policy.Set),
+		Append: redactHeaders(policy.Append),
+		Remove: policy.Remove,
+	}
+}
+
+// shownHeaders - headers whose values are shown by RedactSecrets, as they
+// only route requests. Any other value may be a credential, written literally
+// or resolved from a reference
+var shownHeaders = map[string]bool{
+	"host": true,
+}
+
+func redactHeaders(headers map[string]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(headers))
+	for name, value := range headers {
+		if !shownHeaders[strings.ToLower(name)] || referencesSecret(value) {
+			value = redacted
+		}
+		copied[name] = value
+	}
+	return copied
+}
+
+func referencesSecret(value string) bool {
+	for {
+		start := strings.IndexByte(value, '{')
+		if start < 0 {
+			return false
+		}
+		end := strings.IndexByte(value[start:], '}')
+		if end < 0 {
+			return false
+		}
+		if isSecretReference(value[start+1 : start+end]) {
+			return true
+		}
+		value = value[start+end+1:]
+	}
+}
@@ -0,0 +1,94 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRedactSecretsRedactsHeaderValues(t *testing.T) {
+	rawConfig := NewConfig()
+	rawConfig.Secrets = map[string]string{"api-key": "ciphertext"}
+	rawConfig.Mapping["echo"] = map[VersionString]EndpointConfig{
+		"1.0.0": {
+			Headers: map[string]string{
+				"Host":          "1-0-0.echo.example.com",
+				"Authorization": "Bearer literal-key",
+			},
+			RequestHeaders: &HeaderPolicy{
+				Set:    map[string]string{"X-Api-Key": "{secret:api-key}", "X-Client-Ip": "{client_ip}"},
+				Append: map[string]string{"X-Token": "{env:TOKEN}"},
+				Remove: []string{"cookie"},
+			},
+			ResponseHeaders: &HeaderPolicy{
+				Set: map[string]string{"X-Served-By": "{service}"},
+			},
+			ResponseRewrite: &ResponseRewriteConfig{PublicHost: "{env:PUBLIC_HOST}"},
+		},
+	}
+
+	copied := RedactSecrets(rawConfig)
+	endpoint := copied.Mapping["echo"]["1.0.0"]
+
+	for name, value := range map[string]string{
+		"Host":                         endpoint.Headers["Host"],
+		"Authorization":                endpoint.Headers["Authorization"],
+		"request_headers.X-Api-Key":    endpoint.RequestHeaders.Set["X-Api-Key"],
+		"request_headers.X-Client-Ip":  endpoint.RequestHeaders.Set["X-Client-Ip"],
+		"request_headers.X-Token":      endpoint.RequestHeaders.Append["X-Token"],
+		"response_headers.X-Served-By": endpoint.ResponseHeaders.Set["X-Served-By"],
+		"public_host":                  endpoint.ResponseRewrite.PublicHost,
+		"secrets.api-key":              copied.Secrets["api-key"],
+	} {
+		expected := redacted
+		if name == "Host" {
+			expected = "1-0-0.echo.example.com"
+		}
+		if value != expected {
+			t.Errorf("%s shown as %q, expected %q", name, value, expected)
+		}
+	}
+	if len(endpoint.RequestHeaders.Remove) != 1 {
+		t.Errorf("request_headers.remove not shown: %v", endpoint.RequestHeaders.Remove)
+	}
+
+	original := rawConfig.Mapping["echo"]["1.0.0"]
+	if original.Headers["Authorization"] != "Bearer literal-key" || original.RequestHeaders.Set["X-Api-Key"] != "{secret:api-key}" || original.ResponseRewrite.PublicHost != "{env:PUBLIC_HOST}" {
+		t.Errorf("the original config was modified: %v", original)
+	}
+}
+
+func TestFileSecretsStayWithinTheSecretDir(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "api-key"), []byte("key\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(t.TempDir(), "outside")
+	err = os.WriteFile(outside, []byte("outside"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(outside, filepath.Join(dir, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secrets := &secretStore{}
+
+	t.Setenv(SecretDirEnv, "")
+	if _, err := secrets.resolve("file:api-key"); err == nil {
+		t.Errorf("file secret resolved without %s", SecretDirEnv)
+	}
+
+	t.Setenv(SecretDirEnv, dir)
+	value, err := secrets.resolve("file:api-key")
+	if err != nil || value != "key" {
+		t.Errorf("file:api-key resolved to %q, %v", value, err)
+	}
+	for _, name := range []string{outside, "../outside", "sub/../../outside", "link"} {
+		if value, err := secrets.resolve("file:" + name); err == nil {
+			t.Errorf("file:%s resolved to %q", name, value)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/amerdrix/byway/core"
+
+// TracingConfig - spans are exported over OTLP/HTTP to Endpoint, a host:port.
+// SampleRatio defaults to sampling every request, sampled parents are always followed
+type TracingConfig struct {
+	Endpoint    string            `json:"endpoint" yaml:"endpoint"`
+	Insecure    bool              `json:"insecure,omitempty" yaml:"insecure,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	ServiceName string            `json:"service_name,omitempty" yaml:"service_name,omitempty"`
+	SampleRatio *float64          `json:"sample_ratio,omitempty" yaml:"sample_ratio,omitempty"`
+}
+
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// tracing - the tracer provider of the live config, nil while disabled
+type tracing struct {
+	current atomic.Pointer[tracerProvider]
+}
+
+type tracerProvider struct {
+	config   TracingConfig
+	provider *sdktrace.TracerProvider
+}
+
+func validateTracingConfig(cfg TracingConfig) error {
+	if cfg.Endpoint == "" {
+		return fmt.Errorf("endpoint is required")
+	}
+	if cfg.SampleRatio != nil && (*cfg.SampleRatio < 0 || *cfg.SampleRatio > 1) {
+		return fmt.Errorf("sample_ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+// apply replaces the tracer provider when its config changed, flushing the old one
+func (t *tracing) apply(cfg *TracingConfig) error {
+	old := t.current.Load()
+	if old != nil && cfg != nil && reflect.DeepEqual(old.config, *cfg) {
+		return nil
+	}
+	if old == nil && cfg == nil {
+		return nil
+	}
+
+	var next *tracerProvider
+	if cfg != nil {
+		provider, err := newTracerProvider(*cfg)
+		if err != nil {
+			return err
+		}
+		next = &tracerProvider{config: *cfg, provider: provider}
+	}
+	t.current.Store(next)
+	if old != nil {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			old.provider.Shutdown(ctx)
+		}()
+	}
+	return nil
+}
+
+func newTracerProvider(cfg TracingConfig) (*sdktrace.TracerProvider, error) {
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+	if cfg.Insecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	if len(cfg.Headers) > 0 {
+		options = append(options, otlptracehttp.WithHeaders(cfg.Headers))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = "byway"
+	}
+	ratio := 1.0
+	if cfg.SampleRatio != nil {
+		ratio = *cfg.SampleRatio
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	), nil
+}
+
+// startSpan starts a child of the span in ctx, a no-op while tracing is disabled
+func startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName).Start(ctx, name)
+}
+
+// withTracing starts a span for every request, continuing any trace the
+// client propagated, and records the routing decisions on it
+func withTracing(t *tracing, inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		current := t.current.Load()
+		if current == nil {
+			inner.ServeHTTP(w, req)
+			return
+		}
+
+		ctx := propagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		ctx, span := current.provider.Tracer(tracerName).Start(ctx, "byway "+req.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", req.Method),
+				attribute.String("server.address", req.Host),
+				attribute.String("url.path", req.URL.Path),
+				attribute.String("client.address", req.RemoteAddr),
+			))
+		defer span.End()
+
+		recorder := &responseRecorder{ResponseWriter: w}
+		inner.ServeHTTP(recorder, req.WithContext(ctx))
+
+		route := routeFromContext(ctx)
+		if route.requestID != "" {
+			span.SetAttributes(attribute.String("byway.request_id", route.requestID))
+		}
+		if route.topology != "" {
+			span.SetAttributes(attribute.String("byway.topology", string(route.topology)))
+		}
+		if route.binding != nil {
+			span.SetAttributes(
+				attribute.String("byway.service", string(route.binding.service)),
+				attribute.String("byway.version", string(route.binding.version)),
+				attribute.String("byway.binding.host", route.binding.host),
+			)
+		}
+		if route.failure != "" {
+			span.SetAttributes(attribute.String("byway.resolution_failure", route.failure))
+		}
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
@@ -0,0 +1,100 @@
+package core
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// collector - a stand in for an OTLP/HTTP collector, recording exported spans
+type collector struct {
+	lock  sync.Mutex
+	spans map[string]map[string]string
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	request := &coltracepb.ExportTraceServiceRequest{}
+	err := proto.Unmarshal(body, request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, resourceSpans := range request.ResourceSpans {
+		for _, scopeSpans := range resourceSpans.ScopeSpans {
+			for _, span := range scopeSpans.Spans {
+				attributes := make(map[string]string)
+				for _, attribute := range span.Attributes {
+					attributes[attribute.Key] = attribute.Value.GetStringValue()
+				}
+				c.spans[span.Name] = attributes
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+}
+
+func TestTracingExportsRoutingSpans(t *testing.T) {
+	var traceparent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer upstream.Close()
+
+	spans := &collector{spans: make(map[string]map[string]string)}
+	otlp := httptest.NewServer(spans)
+	defer otlp.Close()
+
+	rawConfig := NewConfig()
+	rawConfig.Mapping["echo"] = map[VersionString]EndpointConfig{
+		"1.0.0": {Host: strings.TrimPrefix(upstream.URL, "http://"), Scheme: "http"},
+	}
+	rawConfig.Tracing = &TracingConfig{Endpoint: strings.TrimPrefix(otlp.URL, "http://"), Insecure: true}
+	config, err := mapConfig(rawConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := newProxyState()
+	state.current.Store(config)
+	err = state.tracing.apply(rawConfig.Tracing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := withRoute(defaultListenerName, withTracing(&state.tracing, newBywayHandler(state)))
+
+	req := httptest.NewRequest(http.MethodGet, "http://1-0-0.echo.example.com/", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	err = state.tracing.current.Load().provider.ForceFlush(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(traceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-") || strings.Contains(traceparent, "00f067aa0ba902b7") {
+		t.Errorf("upstream traceparent %q does not continue the trace from byway's span", traceparent)
+	}
+
+	spans.lock.Lock()
+	defer spans.lock.Unlock()
+	for _, name := range []string{"byway GET", "rewrite", "extract", "resolve"} {
+		if _, ok := spans.spans[name]; !ok {
+			t.Errorf("span %q was not exported, got %v", name, spans.spans)
+		}
+	}
+	attributes := spans.spans["byway GET"]
+	if attributes["byway.service"] != "echo" || attributes["byway.version"] != "1.0.0" {
+		t.Errorf("unexpected routing attributes %v", attributes)
+	}
+}
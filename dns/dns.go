@@ -0,0 +1,202 @@
+package bywayDNS
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/amerdrix/byway/core"
+	"github.com/miekg/dns"
+)
+
+var logger = core.Logger().With("component", "dns")
+
+const defaultListen = ":53"
+const defaultTTL = 5
+
+// zoneTable - the names the dns server answers for, built from a config
+type zoneTable struct {
+	domains   []string
+	addresses []net.IP
+	upstream  string
+	ttl       uint32
+}
+
+type server struct {
+	table atomic.Value
+}
+
+func newZoneTable(rawConfig *core.Config) *zoneTable {
+	table := &zoneTable{ttl: defaultTTL}
+
+	dnsConfig := rawConfig.DNS
+	if dnsConfig == nil {
+		return table
+	}
+
+	for _, domain := range dnsConfig.Domains {
+		table.domains = append(table.domains, strings.ToLower(dns.Fqdn(domain)))
+	}
+
+	addresses := dnsConfig.Addresses
+	if len(addresses) == 0 {
+		addresses = []string{"127.0.0.1", "::1"}
+	}
+	for _, address := range addresses {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			logger.Warn("invalid address", "address", address)
+			continue
+		}
+		table.addresses = append(table.addresses, ip)
+	}
+
+	table.upstream = dnsConfig.Upstream
+	if dnsConfig.TTL != 0 {
+		table.ttl = dnsConfig.TTL
+	}
+
+	return table
+}
+
+// lookup reports whether name falls within a byway domain, and if so whether
+// the listeners of the config the proxy serves route it to a known service
+func (table *zoneTable) lookup(name string) (owned bool, known bool) {
+	name = strings.ToLower(name)
+	for _, domain := range table.domains {
+		if name == domain {
+			return true, true
+		}
+		if strings.HasSuffix(name, "."+domain) {
+			return true, core.CurrentResolver().Resolves(strings.TrimSuffix(name, "."))
+		}
+	}
+	return false, false
+}
+
+func (table *zoneTable) answer(question dns.Question) []dns.RR {
+	answer := make([]dns.RR, 0)
+	for _, ip := range table.addresses {
+		header := dns.RR_Header{Name: question.Name, Class: dns.ClassINET, Ttl: table.ttl}
+		if ip4 := ip.To4(); ip4 != nil {
+			if question.Qtype == dns.TypeA {
+				header.Rrtype = dns.TypeA
+				answer = append(answer, &dns.A{Hdr: header, A: ip4})
+			}
+		} else if question.Qtype == dns.TypeAAAA {
+			header.Rrtype = dns.TypeAAAA
+			answer = append(answer, &dns.AAAA{Hdr: header, AAAA: ip})
+		}
+	}
+	return answer
+}
+
+func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	table := s.table.Load().(*zoneTable)
+
+	if len(req.Question) != 1 {
+		forward(w, req, table.upstream)
+		return
+	}
+
+	question := req.Question[0]
+	owned, known := table.lookup(question.Name)
+	if !owned {
+		forward(w, req, table.upstream)
+		return
+	}
+
+	msg := new(dns.Msg)
+	msg.SetReply(req)
+	msg.Authoritative = true
+	if known {
+		msg.Answer = table.answer(question)
+	} else {
+		logger.Debug("unknown service", "name", question.Name)
+		msg.Rcode = dns.RcodeNameError
+	}
+	w.WriteMsg(msg)
+}
+
+func forward(w dns.ResponseWriter, req *dns.Msg, upstream string) {
+	if upstream == "" {
+		msg := new(dns.Msg)
+		msg.SetRcode(req, dns.RcodeRefused)
+		w.WriteMsg(msg)
+		return
+	}
+
+	client := &dns.Client{Net: "udp"}
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		client.Net = "tcp"
+	}
+
+	resp, _, err := client.Exchange(req, upstream)
+	if err != nil {
+		logger.Warn("forward failed", "upstream", upstream, "err", err)
+		msg := new(dns.Msg)
+		msg.SetRcode(req, dns.RcodeServerFailure)
+		w.WriteMsg(msg)
+		return
+	}
+	w.WriteMsg(resp)
+}
+
+// listen binds addr over udp and tcp before serving, so a port which cannot
+// be bound is reported to the caller rather than ending the process
+func (s *server) listen(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	servers := []*dns.Server{
+		{PacketConn: conn, Handler: s},
+		{Listener: listener, Handler: s},
+	}
+	for _, srv := range servers {
+		go func(srv *dns.Server) {
+			err := srv.ActivateAndServe()
+			if err != nil {
+				logger.Error("dns server stopped", "err", err)
+			}
+		}(srv)
+	}
+	return nil
+}
+
+// Init run the dns server once a config enables it. Names are resolved as the
+// listeners of the config core is serving route them; the listen address is
+// fixed by the first config which can bind it.
+func Init(configChan chan *core.Config, exit chan bool) {
+	s := &server{}
+	s.table.Store(&zoneTable{})
+
+	go func() {
+		started := false
+		for {
+			rawConfig := <-configChan
+			s.table.Store(newZoneTable(rawConfig))
+
+			if !started && rawConfig.DNS != nil {
+				addr := rawConfig.DNS.Listen
+				if addr == "" {
+					addr = defaultListen
+				}
+				err := s.listen(addr)
+				if err != nil {
+					// retried when the next config arrives
+					logger.Error("could not start dns server", "address", addr, "err", err)
+					continue
+				}
+				started = true
+				logger.Info("listening", "address", addr)
+			}
+		}
+	}()
+}